@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	defaultReadSize    = 4096
+	defaultBatchWindow = 5 * time.Millisecond
+	// maxReadSize keeps a batch, plus compression overhead, under the
+	// 64KiB SCTP message size browsers accept.
+	maxReadSize = 60 << 10
+)
+
+// checkReadSize validates the -read-size flag.
+func checkReadSize(size int) error {
+	if size < 1 || size > maxReadSize {
+		return fmt.Errorf("-read-size should be between 1 and %d bytes, not %d", maxReadSize, size)
+	}
+	return nil
+}
+
+// readBatches reads from r until it fails and calls send with batches of
+// up to size bytes. A read after a quiet spell is sent straight away, so
+// typing and its echo aren't delayed. Reads that follow closely during a
+// burst are collected for up to window, or until size bytes are waiting,
+// to send fewer messages. The read error is returned once everything read
+// has been sent. If send fails, reading stops once the read in progress
+// returns, closing r stops it straight away.
+func readBatches(r io.Reader, size int, window time.Duration, send func([]byte) error) error {
+	if size <= 0 {
+		size = defaultReadSize
+	}
+	chunks := make(chan []byte, 16)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			buf := make([]byte, size)
+			n, err := r.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+
+	var batch []byte
+	var deadline <-chan time.Time
+	var lastSend time.Time
+	flush := func() error {
+		deadline = nil
+		lastSend = time.Now()
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > size {
+				n = size
+			}
+			if err := send(batch[:n]); err != nil {
+				return err
+			}
+			batch = batch[n:]
+		}
+		batch = nil
+		return nil
+	}
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				if err := flush(); err != nil {
+					return err
+				}
+				return readErr
+			}
+			if batch == nil {
+				batch = chunk
+			} else {
+				batch = append(batch, chunk...)
+			}
+			if window <= 0 || len(batch) >= size || (deadline == nil && time.Since(lastSend) > window) {
+				if err := flush(); err != nil {
+					return err
+				}
+			} else if deadline == nil {
+				deadline = time.After(window)
+			}
+		case <-deadline:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBatchesKeystroke(t *testing.T) {
+	r, w := io.Pipe()
+	sent := make(chan string, 10)
+	go readBatches(r, 1024, 300*time.Millisecond, func(b []byte) error {
+		sent <- string(b)
+		return nil
+	})
+	for _, key := range []string{"a", "b"} {
+		w.Write([]byte(key))
+		select {
+		case got := <-sent:
+			if got != key {
+				t.Errorf("got %q, want %q", got, key)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("a keystroke after a pause should be sent straight away")
+		}
+		time.Sleep(400 * time.Millisecond)
+	}
+	w.Close()
+}
+
+func TestReadBatchesBurst(t *testing.T) {
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(w, "%03d%s\n", i, strings.Repeat("x", 96))
+		}
+		w.Close()
+	}()
+	var batches [][]byte
+	err := readBatches(r, 1024, 50*time.Millisecond, func(b []byte) error {
+		batches = append(batches, append([]byte(nil), b...))
+		return nil
+	})
+	if err != io.EOF {
+		t.Error(err)
+	}
+	if len(batches) > 20 {
+		t.Errorf("100 writes were sent as %d messages", len(batches))
+	}
+	var all []byte
+	for _, b := range batches {
+		if len(b) > 1024 {
+			t.Errorf("a %d byte batch is over the read size", len(b))
+		}
+		all = append(all, b...)
+	}
+	if len(all) != 100*100 || !bytes.HasPrefix(all, []byte("000x")) || !bytes.HasSuffix(all, []byte("x\n")) {
+		t.Errorf("output was changed, got %d bytes", len(all))
+	}
+}
+
+// chanReader reads the chunks sent on it, and blocks until there is one.
+type chanReader chan []byte
+
+func (r chanReader) Read(p []byte) (int, error) {
+	chunk, ok := <-r
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, chunk), nil
+}
+
+func TestReadBatchesSendError(t *testing.T) {
+	failed := fmt.Errorf("closed")
+	err := readBatches(strings.NewReader("output"), 1024, 0, func([]byte) error {
+		return failed
+	})
+	if err != failed {
+		t.Error(err)
+	}
+
+	// The reader stops instead of blocking forever on batches nobody takes.
+	r := make(chanReader, 64)
+	for i := 0; i < cap(r); i++ {
+		r <- []byte("output")
+	}
+	before := runtime.NumGoroutine()
+	if err = readBatches(r, 1024, 0, func([]byte) error { return failed }); err != failed {
+		t.Error(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("the reader kept running after send failed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCheckReadSize(t *testing.T) {
+	for size, ok := range map[int]bool{0: false, 1: true, 4096: true, maxReadSize: true, 64 << 10: false} {
+		if err := checkReadSize(size); (err == nil) != ok {
+			t.Errorf("checkReadSize(%d) = %v", size, err)
+		}
+	}
+}
+
+// BenchmarkReadBatches feeds output the way a pty delivers a burst, in
+// small reads a little apart, and reports how many messages are sent.
+func BenchmarkReadBatches(b *testing.B) {
+	output := lsOutput()
+	for _, size := range []int{1024, 4096, 16384} {
+		for _, window := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond} {
+			b.Run(fmt.Sprintf("size=%d/window=%s", size, window), func(b *testing.B) {
+				b.SetBytes(int64(len(output)))
+				var msgs int
+				for n := 0; n < b.N; n++ {
+					r, w := io.Pipe()
+					go func() {
+						for start := 0; start < len(output); start += 256 {
+							end := start + 256
+							if end > len(output) {
+								end = len(output)
+							}
+							w.Write(output[start:end])
+							time.Sleep(20 * time.Microsecond)
+						}
+						w.Close()
+					}()
+					msgs = 0
+					readBatches(r, size, window, func([]byte) error {
+						msgs++
+						return nil
+					})
+				}
+				b.ReportMetric(float64(msgs), "msgs")
+			})
+		}
+	}
+}
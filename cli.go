@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a webtty subcommand. setup registers the command's flags and
+// returns the function that runs it once they are parsed.
+type command struct {
+	name    string
+	args    string
+	summary string
+	setup   func(flags *flag.FlagSet) func() error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "host", args: "[-- command [args...]]", setup: hostCommand,
+			summary: "Share a terminal session. Runs \"bash -l\" unless a command is given"},
+		{name: "join", args: "[offer]", setup: joinCommand,
+			summary: "Connect to a session using the offer printed by the host"},
+		{name: "turn-server", setup: turnServerCommand,
+			summary: "Run a STUN/TURN relay for peers that can't connect directly"},
+		{name: "doctor", setup: doctorCommand,
+			summary: "Check NAT type and which network paths work, to explain failed connections"},
+		{name: "version", setup: versionCommand,
+			summary: "Print the webtty version"},
+		{name: "completion", args: "bash|zsh|fish", setup: completionCommand,
+			summary: "Print a shell completion script"},
+		{name: "help", args: "[command]", setup: helpCommand,
+			summary: "Show help for a command"},
+	}
+}
+
+func findCommand(name string) *command {
+	for i, c := range commands {
+		if c.name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// runCommand runs the subcommand named by the first argument, or falls
+// back to the original flag-only invocation.
+func runCommand(args []string) error {
+	if len(args) > 0 {
+		if c := findCommand(args[0]); c != nil {
+			return c.run(args[1:])
+		}
+	}
+	return runLegacy(args)
+}
+
+func (c *command) flags() (*flag.FlagSet, func() error) {
+	flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+	run := c.setup(flags)
+	flags.Usage = func() { c.printUsage(flags) }
+	return flags, run
+}
+
+func (c *command) run(args []string) error {
+	flags, run := c.flags()
+	flags.Parse(args)
+	return run()
+}
+
+func (c *command) printUsage(flags *flag.FlagSet) {
+	w := flags.Output()
+	usage := "webtty " + c.name
+	hasFlags := false
+	flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		usage += " [flags]"
+	}
+	if c.args != "" {
+		usage += " " + c.args
+	}
+	fmt.Fprintf(w, "Usage: %s\n\n%s\n", usage, c.summary)
+	if hasFlags {
+		fmt.Fprintf(w, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: webtty <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun \"webtty help <command>\" for the flags of a command.\n"+
+		"\"webtty [flags]\" and \"webtty [flags] OFFER\" still host and join,\n"+
+		"with -cmd taking the remainder of the command line.\n")
+}
+
+func helpCommand(flags *flag.FlagSet) func() error {
+	return func() error {
+		if flags.NArg() == 0 {
+			printUsage(os.Stdout)
+			return nil
+		}
+		c := findCommand(flags.Arg(0))
+		if c == nil {
+			return fmt.Errorf("unknown command %q", flags.Arg(0))
+		}
+		cmdFlags, _ := c.flags()
+		cmdFlags.SetOutput(os.Stdout)
+		c.printUsage(cmdFlags)
+		return nil
+	}
+}
+
+func versionCommand(flags *flag.FlagSet) func() error {
+	return func() error {
+		fmt.Printf("webtty %s\n", version)
+		return nil
+	}
+}
+
+func completionCommand(flags *flag.FlagSet) func() error {
+	return func() error {
+		if flags.NArg() != 1 {
+			return fmt.Errorf("completion needs a shell: bash, zsh or fish")
+		}
+		return writeCompletion(os.Stdout, flags.Arg(0))
+	}
+}
+
+// commandFlags lists the flags of every command, for completion scripts.
+func commandFlags() map[string][]*flag.Flag {
+	all := map[string][]*flag.Flag{}
+	for i := range commands {
+		c := &commands[i]
+		flags := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.setup(flags)
+		flags.VisitAll(func(f *flag.Flag) {
+			all[c.name] = append(all[c.name], f)
+		})
+	}
+	return all
+}
+
+func writeCompletion(w io.Writer, shell string) error {
+	flags := commandFlags()
+	switch shell {
+	case "bash", "zsh":
+		if shell == "zsh" {
+			fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+		}
+		var names []string
+		for _, c := range commands {
+			names = append(names, c.name)
+		}
+		fmt.Fprintf(w, "_webtty() {\n"+
+			"\tlocal cur=${COMP_WORDS[COMP_CWORD]}\n"+
+			"\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n"+
+			"\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n"+
+			"\t\treturn\n"+
+			"\tfi\n"+
+			"\tcase \"${COMP_WORDS[1]}\" in\n", strings.Join(names, " "))
+		for _, c := range commands {
+			if c.name == "completion" {
+				fmt.Fprintf(w, "\tcompletion) COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")) ;;\n")
+				continue
+			}
+			if c.name == "help" {
+				fmt.Fprintf(w, "\thelp) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(names, " "))
+				continue
+			}
+			var opts []string
+			for _, f := range flags[c.name] {
+				opts = append(opts, "-"+f.Name)
+			}
+			if len(opts) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n",
+				c.name, strings.Join(opts, " "))
+		}
+		fmt.Fprintf(w, "\tesac\n}\ncomplete -o default -F _webtty webtty\n")
+	case "fish":
+		fmt.Fprintln(w, "complete -c webtty -f")
+		for _, c := range commands {
+			fmt.Fprintf(w, "complete -c webtty -n __fish_use_subcommand -a %s -d %s\n",
+				c.name, fishQuote(c.summary))
+		}
+		for _, c := range commands {
+			for _, f := range flags[c.name] {
+				fmt.Fprintf(w, "complete -c webtty -n '__fish_seen_subcommand_from %s' -o %s -d %s\n",
+					c.name, f.Name, fishQuote(strings.SplitN(f.Usage, "\n", 2)[0]))
+			}
+		}
+		fmt.Fprintln(w, "complete -c webtty -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'")
+	default:
+		return fmt.Errorf("unsupported shell %q, use bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "\\'", -1) + "'"
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCmdFlag(t *testing.T) {
+	flags, cmd := splitCmdFlag(strings.Fields("-o -v -cmd docker run -it --rm alpine sh"))
+	if !reflect.DeepEqual(flags, []string{"-o", "-v"}) {
+		t.Error("unexpected flags", flags)
+	}
+	if !reflect.DeepEqual(cmd, strings.Fields("docker run -it --rm alpine sh")) {
+		t.Error("unexpected command", cmd)
+	}
+	if _, cmd = splitCmdFlag([]string{"-o"}); cmd != nil {
+		t.Error("no -cmd means no command", cmd)
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	if c := findCommand("turn-server"); c == nil || c.name != "turn-server" {
+		t.Error("turn-server should be found")
+	}
+	if findCommand("relay") != nil {
+		t.Error("relay is the 10kb.site relay or a candidate type, not a command")
+	}
+	if findCommand("25FrtDEjh7yuGdWMk7R9Phz") != nil {
+		t.Error("offers aren't commands")
+	}
+}
+
+func TestHostCommandArgs(t *testing.T) {
+	c := findCommand("host")
+	flags, _ := c.flags()
+	if err := flags.Parse(strings.Fields("-ni -ttl 1m -- tmux attach -t shared")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(flags.Args(), strings.Fields("tmux attach -t shared")) {
+		t.Error("everything after -- is the command", flags.Args())
+	}
+	if flags.Lookup("discover") != nil {
+		t.Error("join flags shouldn't be on host")
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		var buf bytes.Buffer
+		if err := writeCompletion(&buf, shell); err != nil {
+			t.Fatal(err)
+		}
+		script := buf.String()
+		for _, want := range []string{"turn-server", "completion", "discover", "relay-only"} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s completion is missing %q", shell, want)
+			}
+		}
+	}
+	if err := writeCompletion(&bytes.Buffer{}, "tcsh"); err == nil {
+		t.Error("unknown shells should error")
+	}
+}
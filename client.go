@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/kr/pty"
@@ -19,6 +22,21 @@ type clientSession struct {
 	session
 	dc          *webrtc.DataChannel
 	offerString string
+	qr          bool
+	discover    bool
+	stats       bool
+	escapeChar  byte
+	escape      *escapeFilter
+	cmdLine     *commandLine
+	predict     *predictor
+	sync        bool
+	syncState   uint32
+	compress    bool
+	inflate     *inflater
+	deflate     *deflater
+	sendMu      sync.Mutex
+	stdoutMu    sync.Mutex
+	sendEnvs    []string
 }
 
 func sendTermSize(term *os.File, dcSend func(s string) error) error {
@@ -35,11 +53,22 @@ func sendTermSize(term *os.File, dcSend func(s string) error) error {
 func (cs *clientSession) dataChannelOnOpen() func() {
 	return func() {
 		log.Printf("Data channel '%s'-'%d'='%d' open.\n", cs.dc.Label(), cs.dc.ID(), cs.dc.MaxPacketLifeTime())
+		if cs.offer.Exec {
+			cs.execOnOpen()
+			return
+		}
 		colorstring.Println("[bold]Terminal session started:")
 
-		if err := cs.makeRawTerminal(); err != nil {
-			log.Println(err)
-			cs.errChan <- err
+		if cs.isTerminal {
+			if err := cs.makeRawTerminal(); err != nil {
+				log.Println(err)
+				cs.errChan <- err
+			}
+			if cs.sync {
+				// Synced screens are drawn on the alternate screen, like a
+				// full screen program.
+				cs.write([]byte("\x1b[?1049h"))
+			}
 		}
 
 		ch := make(chan os.Signal, 1)
@@ -54,25 +83,155 @@ func (cs *clientSession) dataChannelOnOpen() func() {
 			}
 		}()
 		ch <- syscall.SIGWINCH // Initial resize.
-		buf := make([]byte, 1024)
-		for {
-			nr, err := os.Stdin.Read(buf)
-			if err != nil {
-				log.Println(err)
-				cs.errChan <- err
+		go cs.forwardSignals()
+		if cs.stats {
+			go cs.watchStats(cs.dc, cs.showStats)
+		}
+		cs.waitForSignaling()
+		cs.escape = newEscapeFilter(cs.escapeChar)
+		err := readBatches(os.Stdin, cs.readSize, cs.batchWindow, func(input []byte) error {
+			if cs.isTerminal {
+				if input = cs.handleEscapes(input); len(input) == 0 {
+					return nil
+				}
 			}
-			err = cs.dc.Send(buf[0:nr])
-			if err != nil {
-				log.Println(err)
-				cs.errChan <- err
+			if cs.predict != nil {
+				cs.stdoutMu.Lock()
+				os.Stdout.Write(cs.predict.userInput(input))
+				cs.stdoutMu.Unlock()
 			}
+			return cs.send(input)
+		})
+		log.Println(err)
+		cs.errChan <- err
+	}
+}
+
+// handleEscapes runs escape commands and the ~C command line, and returns
+// the rest of the input to send to the host.
+func (cs *clientSession) handleEscapes(input []byte) (out []byte) {
+	for len(input) > 0 {
+		if cs.cmdLine != nil {
+			echo, line, done, rest := cs.cmdLine.feed(input)
+			cs.write(echo)
+			if !done {
+				return
+			}
+			cs.cmdLine = nil
+			cs.runCommandLine(line)
+			input = rest
+			continue
+		}
+		forward, cmd, rest := cs.escape.filter(input)
+		out = append(out, forward...)
+		if cmd != 0 {
+			cs.escapeCommand(cmd)
+		}
+		input = rest
+	}
+	return
+}
+
+func (cs *clientSession) escapeCommand(cmd byte) {
+	switch cmd {
+	case '.':
+		cs.write([]byte("\r\nDisconnected.\r\n"))
+		select {
+		case cs.errChan <- nil:
+		default:
+		}
+	case '?':
+		cs.write([]byte(escapeHelp(cs.escapeChar)))
+	case 's':
+		cs.showStatus(cs.connStats(cs.dc).String())
+	case 'r':
+		if err := sendTermSize(os.Stdin, cs.dc.SendText); err != nil {
+			log.Println(err)
 		}
+	case 'C':
+		cs.cmdLine = &commandLine{}
+		cs.write([]byte("\r\nwebtty> "))
 	}
 }
 
+// runCommandLine runs a line typed at the ~C prompt.
+func (cs *clientSession) runCommandLine(line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	switch fields[0] {
+	case "help", "?":
+		cs.write([]byte("Commands: stats, resize, signal NAME, disconnect, help\r\n"))
+	case "stats":
+		cs.write([]byte(cs.connStats(cs.dc).String() + "\r\n"))
+	case "resize":
+		cs.escapeCommand('r')
+	case "signal", "kill":
+		if len(fields) != 2 {
+			cs.write([]byte("Usage: signal NAME, eg: signal TERM\r\n"))
+			return
+		}
+		if err := cs.sendSignal(strings.TrimPrefix(fields[1], "-")); err != nil {
+			cs.write([]byte(err.Error() + "\r\n"))
+		}
+	case "disconnect", "quit", "exit":
+		cs.escapeCommand('.')
+	case "-L", "-R", "-D":
+		cs.write([]byte("Port forwarding isn't supported by webtty.\r\n"))
+	default:
+		cs.write([]byte(fmt.Sprintf("Unknown command %q, try help\r\n", fields[0])))
+	}
+}
+
+func (cs *clientSession) write(b []byte) {
+	cs.stdoutMu.Lock()
+	defer cs.stdoutMu.Unlock()
+	os.Stdout.Write(b)
+}
+
+func (cs *clientSession) showStats(stats connStats) {
+	cs.showStatus(stats.String())
+}
+
+// showStatus draws status on the bottom line of the terminal, or prints it
+// to stderr when stdin isn't a terminal or stdout carries -exec output.
+func (cs *clientSession) showStatus(status string) {
+	cs.stdoutMu.Lock()
+	defer cs.stdoutMu.Unlock()
+	if !cs.isTerminal || cs.offer.Exec {
+		fmt.Fprintf(os.Stderr, "%s\n", status)
+		return
+	}
+	ws, err := pty.GetsizeFull(os.Stdin)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// Save the cursor, draw in reverse video on the last row, restore.
+	fmt.Printf("\x1b7\x1b[%d;1H\x1b[2K\x1b[7m %s \x1b[0m\x1b8", ws.Rows, status)
+}
+
 func (cs *clientSession) dataChannelOnMessage() func(payload webrtc.DataChannelMessage) {
 	return func(p webrtc.DataChannelMessage) {
+		cs.seen()
 		if p.IsString {
+			if len(p.Data) > 2 && p.Data[0] == '[' && p.Data[1] == '"' {
+				var msg []string
+				if err := json.Unmarshal(p.Data, &msg); err == nil {
+					if cs.handleHeartbeat(msg, cs.dc.SendText) || cs.handleExecMessage(msg) {
+						return
+					}
+					if msg[0] == "notice" && len(msg) > 1 {
+						cs.showStatus(msg[1])
+						return
+					}
+					if msg[0] == "compress" && len(msg) > 1 && msg[1] == compressFeature {
+						cs.startCompressing()
+						return
+					}
+				}
+			}
 			if string(p.Data) == "quit" {
 				if cs.isTerminal {
 					terminal.Restore(int(os.Stdin.Fd()), cs.oldTerminalState)
@@ -82,9 +241,80 @@ func (cs *clientSession) dataChannelOnMessage() func(payload webrtc.DataChannelM
 			}
 			cs.errChan <- fmt.Errorf(`Unmatched string message: "%s"`, string(p.Data))
 		} else {
+			data := p.Data
+			if cs.inflate != nil {
+				var err error
+				if data, err = cs.inflate.decompress(data); err != nil {
+					log.Println(err)
+					cs.errChan <- err
+					return
+				}
+			}
+			if cs.offer.Exec {
+				if err := cs.writeOutput(data); err != nil {
+					log.Println(err)
+					cs.errChan <- err
+				}
+				return
+			}
+			cs.stdoutMu.Lock()
+			if cs.predict != nil {
+				data = cs.predict.hostOutput(data)
+			}
 			f := bufio.NewWriter(os.Stdout)
-			f.Write(p.Data)
+			f.Write(data)
 			f.Flush()
+			cs.stdoutMu.Unlock()
+		}
+	}
+}
+
+// startCompressing is called when the host starts compressing output. The
+// client compresses its input from then on too.
+func (cs *clientSession) startCompressing() {
+	cs.inflate = &inflater{}
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+	if err := cs.dc.SendText(compressMessage); err != nil {
+		log.Println(err)
+		return
+	}
+	cs.deflate = newDeflater()
+}
+
+// send sends input to the host.
+func (cs *clientSession) send(input []byte) (err error) {
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+	if cs.deflate != nil {
+		if input, err = cs.deflate.compress(input); err != nil {
+			return err
+		}
+	}
+	return cs.dc.Send(input)
+}
+
+// syncOnMessage draws screen frames from the host and acknowledges them.
+func (cs *clientSession) syncOnMessage() func(payload webrtc.DataChannelMessage) {
+	return func(p webrtc.DataChannelMessage) {
+		cs.seen()
+		num, base, payload, err := decodeFrame(p.Data)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if !acceptFrame(cs.syncState, num, base) {
+			return
+		}
+		cs.stdoutMu.Lock()
+		if cs.predict != nil {
+			payload = cs.predict.hostOutput(payload)
+		}
+		os.Stdout.Write(payload)
+		cs.stdoutMu.Unlock()
+		cs.syncState = num
+		if err := cs.dc.SendText(fmt.Sprintf(`["ack","%d"]`, num)); err != nil {
+			log.Println(err)
 		}
 	}
 }
@@ -94,12 +324,42 @@ func (cs *clientSession) run() (err error) {
 		return
 	}
 
+	cs.pc.OnDataChannel(cs.onDataChannel())
+
 	maxPacketLifeTime := uint16(1000) // Arbitrary
 	ordered := true
-	if cs.dc, err = cs.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
+	init := &webrtc.DataChannelInit{
 		Ordered:           &ordered,
 		MaxPacketLifeTime: &maxPacketLifeTime,
-	}); err != nil {
+	}
+	var features []string
+	if cs.sync {
+		// Screen frames go on their own channel where loss doesn't matter.
+		unordered := false
+		maxRetransmits := uint16(0)
+		var syncDC *webrtc.DataChannel
+		if syncDC, err = cs.pc.CreateDataChannel("sync", &webrtc.DataChannelInit{
+			Ordered:        &unordered,
+			MaxRetransmits: &maxRetransmits,
+		}); err != nil {
+			log.Println(err)
+			return
+		}
+		syncDC.OnMessage(cs.syncOnMessage())
+		features = append(features, syncProtocol)
+	}
+	if cs.compress {
+		features = append(features, compressFeature)
+	}
+	if len(features) > 0 {
+		// Control messages for -sync and compressed streams can't be lost,
+		// so the channel is reliable.
+		init = &webrtc.DataChannelInit{Ordered: &ordered}
+	}
+	// These don't need a reliable channel, so they're always offered.
+	protocol := strings.Join(append(features, envFeature, heartbeatFeature), ",")
+	init.Protocol = &protocol
+	if cs.dc, err = cs.pc.CreateDataChannel("data", init); err != nil {
 		log.Println(err)
 		return
 	}
@@ -107,16 +367,44 @@ func (cs *clientSession) run() (err error) {
 	cs.dc.OnOpen(cs.dataChannelOnOpen())
 	cs.dc.OnMessage(cs.dataChannelOnMessage())
 
-	if cs.offer, err = sd.Decode(cs.offerString); err != nil {
+	if cs.discover {
+		var sig *signaler
+		if sig, err = discoverLANHost(); err != nil {
+			log.Println(err)
+			return
+		}
+		cs.trickle(sig)
+		if cs.offer, err = sig.readDescription(); err != nil {
+			log.Println(err)
+			return
+		}
+	} else if cs.offer, err = sd.Decode(cs.offerString); err != nil {
 		log.Println(err)
 		return
 	}
+	if cs.offer.Expired() {
+		return sd.ErrExpired
+	}
 	if cs.offer.Key != "" {
 		if err = cs.offer.Decrypt(); err != nil {
 			log.Println(err)
 			return
 		}
 	}
+	// Offers without an end-of-candidates marker are still gathering, so
+	// trickle our candidates back over stdout as well. 10kb.site isn't a
+	// live channel so those always wait for gathering to complete.
+	if cs.signal == nil && cs.offer.TenKbSiteLoc == "" && !strings.Contains(cs.offer.Sdp, "a=end-of-candidates") {
+		if cs.offer.Exec {
+			return errTrickleExec
+		}
+		cs.trickle(newSignaler(os.Stdin, os.Stdout))
+	}
+	// -exec sessions use stdout for the command's output.
+	ui := os.Stdout
+	if cs.offer.Exec {
+		ui = os.Stderr
+	}
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
 		SDP:  cs.offer.Sdp,
@@ -126,6 +414,9 @@ func (cs *clientSession) run() (err error) {
 		log.Println(err)
 		return err
 	}
+	if cs.signal != nil {
+		go cs.signal.addRemoteCandidates(cs.pc)
+	}
 	// Sets the LocalDescription, and starts our UDP listeners
 	answer, err := cs.pc.CreateAnswer(nil)
 	if err != nil {
@@ -142,8 +433,10 @@ func (cs *clientSession) run() (err error) {
 		return
 	}
 
-	// Block until ICE Gathering is complete
-	<-gatherComplete
+	if cs.signal == nil {
+		// Block until ICE Gathering is complete
+		<-gatherComplete
+	}
 
 	answerSd := sd.SessionDescription{
 		Sdp:   cs.pc.LocalDescription().SDP,
@@ -160,15 +453,37 @@ func (cs *clientSession) run() (err error) {
 	}
 
 	encodedAnswer := sd.Encode(answerSd)
-	if cs.offer.TenKbSiteLoc == "" {
-		fmt.Printf("Answer created. Send the following answer to the host:\n\n")
-		fmt.Println(encodedAnswer)
+	if cs.discover {
+		if err = cs.signal.sendDescription(answerSd); err != nil {
+			log.Println(err)
+			return
+		}
+	} else if cs.offer.TenKbSiteLoc == "" {
+		fmt.Fprintf(ui, "Answer created. Send the following answer to the host:\n\n")
+		if cs.signal != nil {
+			if err = cs.signal.sendDescription(answerSd); err != nil {
+				log.Println(err)
+				return
+			}
+		} else {
+			fmt.Fprintln(ui, encodedAnswer)
+		}
+		if cs.qr {
+			fmt.Fprintln(ui)
+			if err = printQR(ui, encodedAnswer); err != nil {
+				log.Println(err)
+				return
+			}
+		}
 	} else {
 		if err := create10kbFile(cs.offer.TenKbSiteLoc, encodedAnswer); err != nil {
 			return err
 		}
 	}
 	err = <-cs.errChan
+	if cs.sync && cs.isTerminal {
+		cs.write([]byte("\x1b[?1049l\x1b[?1l\x1b>\x1b[?25h"))
+	}
 	cs.cleanup()
 	return err
 }
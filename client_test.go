@@ -45,7 +45,8 @@ func TestClientDataChannelOnMessage(t *testing.T) {
 }
 
 func TestSendTermSize(t *testing.T) {
-	hs := hostSession{ptmxReady: true}
+	hs := hostSession{}
+	hs.started.Store(&runningCommand{})
 	c := exec.Command("sh")
 	var err error
 	hs.ptmx, err = pty.Start(c)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"strings"
+)
+
+// compressFeature is listed in the protocol of the client's data channel
+// when it can take compressed output. The host answers with
+// compressMessage before its first compressed message, and the client does
+// the same before compressing its input.
+const compressFeature = "deflate"
+
+const compressMessage = `["compress","deflate"]`
+
+// deflateWindow is how far back deflate can refer.
+const deflateWindow = 32 << 10
+
+// deflateTail ends a flushed message: the empty stored block that Flush
+// writes, which compress trims, and a final empty block so the reader stops.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// hasFeature reports whether a comma separated data channel protocol lists
+// feature.
+func hasFeature(protocol, feature string) bool {
+	for _, f := range strings.Split(protocol, ",") {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// deflater compresses a stream of messages, like permessage-deflate with
+// context takeover: each message is flushed so it can be decompressed as
+// soon as it arrives, but it can still refer to earlier ones.
+type deflater struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newDeflater() *deflater {
+	d := &deflater{}
+	// Only fails for a bad level.
+	d.w, _ = flate.NewWriter(&d.buf, flate.BestSpeed)
+	return d
+}
+
+func (d *deflater) compress(p []byte) ([]byte, error) {
+	d.buf.Reset()
+	if _, err := d.w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, err
+	}
+	out := d.buf.Bytes()
+	return append([]byte(nil), out[:len(out)-4]...), nil
+}
+
+// inflater decompresses messages from a deflater. It keeps the last
+// deflateWindow of output for the next message to refer to.
+type inflater struct {
+	history []byte
+}
+
+func (i *inflater) decompress(p []byte) ([]byte, error) {
+	data := append(append([]byte(nil), p...), deflateTail...)
+	r := flate.NewReaderDict(bytes.NewReader(data), i.history)
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	i.history = append(i.history, out...)
+	if over := len(i.history) - deflateWindow; over > 0 {
+		i.history = append([]byte(nil), i.history[over:]...)
+	}
+	return out, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDeflateRoundTrip(t *testing.T) {
+	d, i := newDeflater(), &inflater{}
+	rnd := rand.New(rand.NewSource(1))
+	var sent, received []byte
+	for n := 0; n < 200; n++ {
+		msg := []byte(fmt.Sprintf("line %d: %s\r\n", n, strings.Repeat("ab", rnd.Intn(600))))
+		if n%50 == 0 {
+			msg = make([]byte, 1024)
+			rnd.Read(msg)
+		}
+		wire, err := d.compress(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := i.decompress(wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, msg) {
+			t.Fatalf("message %d: got %q, want %q", n, out, msg)
+		}
+		sent = append(sent, msg...)
+		received = append(received, wire...)
+	}
+	if len(received) > len(sent)/2 {
+		t.Errorf("compressed %d bytes to %d", len(sent), len(received))
+	}
+	if _, err := i.decompress([]byte("not deflate")); err == nil {
+		t.Error("expected an error for a corrupt message")
+	}
+}
+
+func TestHasFeature(t *testing.T) {
+	for _, tt := range []struct {
+		protocol string
+		has      bool
+	}{
+		{"", false},
+		{"deflate", true},
+		{"webtty-sync,deflate", true},
+		{"webtty-sync", false},
+		{"deflate-x", false},
+	} {
+		if got := hasFeature(tt.protocol, compressFeature); got != tt.has {
+			t.Errorf("hasFeature(%q) = %t", tt.protocol, got)
+		}
+	}
+}
+
+// lsOutput looks like `ls -R` of a source tree.
+func lsOutput() []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"client", "server", "config", "util", "handler", "test", "index", "main", "types", "api"}
+	exts := []string{".go", ".js", ".json", ".md", ".ts", "_test.go"}
+	var b bytes.Buffer
+	for dir := 0; dir < 400; dir++ {
+		fmt.Fprintf(&b, "./src/%s/%s%d:\r\n", words[rnd.Intn(len(words))], words[rnd.Intn(len(words))], dir)
+		for f := rnd.Intn(12); f >= 0; f-- {
+			fmt.Fprintf(&b, "%s_%s%s  ", words[rnd.Intn(len(words))], words[rnd.Intn(len(words))], exts[rnd.Intn(len(exts))])
+		}
+		b.WriteString("\r\n\r\n")
+	}
+	return b.Bytes()
+}
+
+// logOutput looks like `tail -f` of a web server log.
+func logOutput() []byte {
+	rnd := rand.New(rand.NewSource(1))
+	paths := []string{"/api/v1/items", "/api/v1/users", "/healthz", "/static/app.js", "/login"}
+	var b bytes.Buffer
+	for n := 0; n < 3000; n++ {
+		fmt.Fprintf(&b, "2026-10-19T12:%02d:%02d.%03dZ \x1b[32mINFO\x1b[0m server: request id=%08x method=GET path=%s/%d status=200 duration=%.1fms\r\n",
+			n/60%60, n%60, rnd.Intn(1000), rnd.Uint32(), paths[rnd.Intn(len(paths))], rnd.Intn(10000), rnd.Float64()*50)
+	}
+	return b.Bytes()
+}
+
+// benchmarkDeflate compresses output in the 1024 byte reads the host makes
+// and reports the bytes sent as a fraction of the output.
+func benchmarkDeflate(b *testing.B, output []byte) {
+	b.SetBytes(int64(len(output)))
+	var wire int
+	for n := 0; n < b.N; n++ {
+		d := newDeflater()
+		wire = 0
+		for start := 0; start < len(output); start += 1024 {
+			end := start + 1024
+			if end > len(output) {
+				end = len(output)
+			}
+			msg, err := d.compress(output[start:end])
+			if err != nil {
+				b.Fatal(err)
+			}
+			wire += len(msg)
+		}
+	}
+	b.ReportMetric(float64(wire)/float64(len(output)), "wire/raw")
+}
+
+func BenchmarkDeflateLsR(b *testing.B)     { benchmarkDeflate(b, lsOutput()) }
+func BenchmarkDeflateLogTail(b *testing.B) { benchmarkDeflate(b, logOutput()) }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFlags maps config file settings to the flags they set. Settings
+// only apply when their flag wasn't given on the command line.
+var configFlags = map[string]string{
+	"stun":            "s",
+	"ice":             "ice",
+	"ice_secret":      "ice-secret",
+	"relay_only":      "relay-only",
+	"peer_timeout":    "peer-timeout",
+	"compress":        "compress",
+	"read_size":       "read-size",
+	"batch_window":    "batch-window",
+	"ttl":             "ttl",
+	"idle_timeout":    "idle-timeout",
+	"max_duration":    "max-duration",
+	"slow_client":     "slow-client",
+	"exec":            "exec",
+	"dir":             "dir",
+	"env":             "env",
+	"accept_env":      "accept-env",
+	"send_env":        "send-env",
+	"qr":              "qr",
+	"trickle":         "trickle",
+	"verbose":         "v",
+	"non_interactive": "ni",
+	"one_way":         "o",
+	"stats":           "stats",
+	"escape_char":     "e",
+	"predict":         "predict",
+	"sync":            "sync",
+	"ports":           "ports",
+	"udp_port":        "udp-port",
+	"tcp_port":        "tcp-port",
+	"interfaces":      "interfaces",
+	"ips":             "ips",
+	"nat_ips":         "nat-ip",
+	"network":         "network",
+	"mdns":            "mdns",
+}
+
+// configVars are settings without a flag.
+var configVars = map[string]*string{
+	"relay_url":        &tenKbURL,
+	"relay_upload_url": &tenKbUpURL,
+}
+
+// defaultConfigPath is $XDG_CONFIG_HOME/webtty/config.toml, falling back
+// to ~/.config.
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "webtty", "config.toml")
+}
+
+// loadConfig reads the settings for a profile. Top level settings apply to
+// every profile and a [profiles.NAME] table overrides them. A missing file
+// is only an error when a profile was asked for.
+func loadConfig(path, profile string) (map[string]interface{}, error) {
+	var file map[string]interface{}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		if os.IsNotExist(err) && profile == "" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	settings := map[string]interface{}{}
+	profiles, _ := file["profiles"].(map[string]interface{})
+	delete(file, "profiles")
+	for key, value := range file {
+		settings[key] = value
+	}
+	if profile == "" {
+		return settings, nil
+	}
+	overrides, ok := profiles[profile].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no profile named %q in %s", profile, path)
+	}
+	for key, value := range overrides {
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+// applyConfig sets flags from settings unless they were given on the
+// command line or don't apply to the command, and returns the configured
+// command if there is one.
+func applyConfig(flags *flag.FlagSet, settings map[string]interface{}) (cmd []string, err error) {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := settings[key]
+		if key == "command" {
+			if cmd, err = stringList(key, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if v, ok := configVars[key]; ok {
+			*v = fmt.Sprint(value)
+			continue
+		}
+		name, ok := configFlags[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown config setting %q", key)
+		}
+		if set[name] || flags.Lookup(name) == nil {
+			continue
+		}
+		values := []interface{}{value}
+		if list, isList := value.([]interface{}); isList {
+			values = list
+		}
+		for _, v := range values {
+			if err = flags.Set(name, fmt.Sprint(v)); err != nil {
+				return nil, fmt.Errorf("config setting %q: %s", key, err)
+			}
+		}
+	}
+	return cmd, nil
+}
+
+func stringList(key string, value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config setting %q should be a list of strings", key)
+	}
+	strs := make([]string, len(list))
+	for i, v := range list {
+		if strs[i], ok = v.(string); !ok {
+			return nil, fmt.Errorf("config setting %q should be a list of strings", key)
+		}
+	}
+	return strs, nil
+}
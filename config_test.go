@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+stun = "stun:stun.example.com:3478"
+qr = true
+ttl = "5m"
+command = ["bash", "-l"]
+
+[profiles.work]
+ice = ["turn:a:b@turn.example.com", "turns:turn.example.com:5349"]
+relay_only = true
+command = ["tmux", "attach", "-t", "shared"]
+`
+
+func writeTestConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "webtty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.toml")
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	path := writeTestConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	stun := flags.String("s", "", "")
+	qr := flags.Bool("qr", false, "")
+	relayOnly := flags.Bool("relay-only", false, "")
+	ttl := flags.Duration("ttl", time.Minute, "")
+	var ice iceServerFlags
+	flags.Var(&ice, "ice", "")
+	if err := flags.Parse([]string{"-s", "stun:flag.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := loadConfig(path, "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := applyConfig(flags, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stun != "stun:flag.example.com" {
+		t.Error("command line flags should win", *stun)
+	}
+	if !*qr || !*relayOnly || *ttl != 5*time.Minute {
+		t.Error("settings weren't applied", *qr, *relayOnly, *ttl)
+	}
+	if len(ice) != 2 || ice[0].Username != "a" {
+		t.Error("ice servers weren't applied", ice)
+	}
+	if !reflect.DeepEqual(cmd, []string{"tmux", "attach", "-t", "shared"}) {
+		t.Error("profile should override the command", cmd)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	if settings, err := loadConfig("/does/not/exist.toml", ""); err != nil || settings != nil {
+		t.Error("a missing config file is fine", err)
+	}
+	if _, err := loadConfig("/does/not/exist.toml", "work"); err == nil {
+		t.Error("asking for a profile needs a config file")
+	}
+
+	path := writeTestConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+	if _, err := loadConfig(path, "home"); err == nil {
+		t.Error("unknown profiles should error")
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := applyConfig(flags, map[string]interface{}{"colour": "red"}); err == nil {
+		t.Error("unknown settings should error")
+	}
+	if _, err := applyConfig(flags, map[string]interface{}{"one_way": true}); err != nil {
+		t.Error("settings for flags a command doesn't have should be skipped", err)
+	}
+}
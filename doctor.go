@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/colorstring"
+	"github.com/pion/ice/v2"
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+)
+
+// NAT behaviour as described in RFC 4787 and tested per RFC 5780.
+const (
+	natUnknown           = "unknown"
+	natNone              = "no NAT"
+	natIndependent       = "endpoint-independent"
+	natAddressDependent  = "address-dependent"
+	natAddrPortDependent = "address and port-dependent"
+)
+
+var errNoSTUNResponse = errors.New("no response from the STUN server")
+
+// interfaceAddrs lists the addresses of our interfaces. Tests replace it.
+var interfaceAddrs = net.InterfaceAddrs
+
+// doctorReport is what webtty doctor found out about the local network.
+type doctorReport struct {
+	candidates map[string][]string
+	udp        bool
+	public     []string
+	mapping    string
+	filtering  string
+	tcp        map[string]error
+	relay      bool
+	turn       bool
+}
+
+// doctorCommand checks what connectivity this machine has, to explain why
+// sessions don't connect.
+func doctorCommand(flags *flag.FlagSet) func() error {
+	var o sessionOptions
+	o.baseFlags(flags)
+	o.connectivityFlags(flags)
+	secondSTUN := flags.String("s2", "stun:stun1.l.google.com:19302", "A second STUN server, to tell how the NAT maps ports")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long to wait for each check")
+	return func() error {
+		if _, err := o.configure(flags); err != nil {
+			return err
+		}
+		iceServers := o.iceServers()
+		if *secondSTUN != "" {
+			iceServers = append(iceServers, webrtc.ICEServer{URLs: []string{*secondSTUN}})
+		}
+		colorstring.Printf("[bold]Checking connectivity, this takes a few seconds...\n\n")
+		report := runDoctor(iceServers, o.network, *timeout)
+		report.print(os.Stdout)
+		return nil
+	}
+}
+
+func runDoctor(iceServers []webrtc.ICEServer, network networkOptions, timeout time.Duration) doctorReport {
+	report := doctorReport{
+		candidates: map[string][]string{},
+		tcp:        map[string]error{},
+		turn:       hasTURNServer(iceServers),
+		mapping:    natUnknown,
+		filtering:  natUnknown,
+	}
+
+	candidates, err := gatherCandidates(iceServers, network, timeout)
+	if err != nil {
+		report.candidates["error"] = []string{err.Error()}
+	}
+	for _, c := range candidates {
+		report.candidates[c.Typ.String()] = append(report.candidates[c.Typ.String()],
+			fmt.Sprintf("%s %s", c.Protocol, net.JoinHostPort(c.Address, strconv.Itoa(int(c.Port)))))
+		if c.Typ == webrtc.ICECandidateTypeRelay {
+			report.relay = true
+		}
+	}
+
+	var servers []*net.UDPAddr
+	for _, server := range iceServers {
+		for _, raw := range server.URLs {
+			u, err := ice.ParseURL(raw)
+			if err != nil {
+				continue
+			}
+			if u.Proto == ice.ProtoTypeTCP || u.Scheme == ice.SchemeTypeTURNS || u.Scheme == ice.SchemeTypeSTUNS {
+				report.tcp[raw] = dialTimeout(u.Host, u.Port, timeout)
+				continue
+			}
+			if addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(u.Host, strconv.Itoa(u.Port))); err == nil {
+				servers = append(servers, addr)
+			}
+		}
+	}
+	report.natChecks(servers, timeout)
+	return report
+}
+
+// gatherCandidates collects the local candidates a session would offer.
+func gatherCandidates(iceServers []webrtc.ICEServer, network networkOptions, timeout time.Duration) ([]webrtc.ICECandidate, error) {
+	s := session{iceServers: iceServers, network: network}
+	if err := s.createPeerConnection(); err != nil {
+		return nil, err
+	}
+	defer s.cleanup()
+	defer s.pc.Close()
+
+	candidates := make(chan *webrtc.ICECandidate, 64)
+	s.pc.OnICECandidate(func(c *webrtc.ICECandidate) { candidates <- c })
+	if _, err := s.pc.CreateDataChannel("doctor", nil); err != nil {
+		return nil, err
+	}
+	offer, err := s.pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.pc.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+
+	var gathered []webrtc.ICECandidate
+	deadline := time.After(timeout)
+	for {
+		select {
+		case c := <-candidates:
+			if c == nil {
+				return gathered, nil
+			}
+			gathered = append(gathered, *c)
+		case <-deadline:
+			return gathered, nil
+		}
+	}
+}
+
+func dialTimeout(host string, port int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// natChecks finds the mapping behaviour by asking two STUN servers for our
+// address from the same socket, and the filtering behaviour by asking a
+// server that supports RFC 5780 to answer from its other address.
+func (r *doctorReport) natChecks(servers []*net.UDPAddr, timeout time.Duration) {
+	if len(servers) == 0 {
+		return
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var first stunResponse
+	var server *net.UDPAddr
+	var rest []*net.UDPAddr
+	for i := range servers {
+		if first, err = stunBinding(conn, servers[i], 0, timeout); err == nil {
+			server, rest = servers[i], servers[i+1:]
+			break
+		}
+	}
+	if server == nil {
+		return
+	}
+	other := first.other
+	r.udp = true
+	r.public = append(r.public, first.mapped.String())
+	if isLocalIP(first.mapped.IP) {
+		r.mapping, r.filtering = natNone, natNone
+		return
+	}
+
+	// Prefer the server's alternate address, otherwise any other server at
+	// a different address.
+	var second *net.UDPAddr
+	if other != nil {
+		second = &net.UDPAddr{IP: other.IP, Port: other.Port}
+	}
+	for _, s := range rest {
+		if second == nil && s.String() != server.String() {
+			second = s
+		}
+	}
+	if second != nil {
+		if res, err := stunBinding(conn, second, 0, timeout); err == nil {
+			if res.mapped.String() == first.mapped.String() {
+				r.mapping = natIndependent
+			} else {
+				r.mapping = natAddrPortDependent
+				r.public = append(r.public, res.mapped.String())
+			}
+		}
+	}
+
+	if other == nil {
+		return
+	}
+	switch {
+	case stunChange(conn, server, changeIP|changePort, timeout):
+		r.filtering = natIndependent
+	case stunChange(conn, server, changePort, timeout):
+		r.filtering = natAddressDependent
+	default:
+		r.filtering = natAddrPortDependent
+	}
+}
+
+// CHANGE-REQUEST flags from RFC 5780.
+const (
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// stunChange reports whether a response sent from the server's other
+// address or port gets through the NAT.
+func stunChange(conn net.PacketConn, server *net.UDPAddr, change byte, timeout time.Duration) bool {
+	res, err := stunBinding(conn, server, change, timeout)
+	return err == nil && res.from.String() != server.String()
+}
+
+type stunResponse struct {
+	mapped, other, from *net.UDPAddr
+}
+
+// stunBinding sends a binding request, with a CHANGE-REQUEST when change
+// is set, and returns our mapped address and the server's OTHER-ADDRESS.
+func stunBinding(conn net.PacketConn, server *net.UDPAddr, change byte, timeout time.Duration) (res stunResponse, err error) {
+	setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if change != 0 {
+		setters = append(setters, stun.RawAttribute{Type: stun.AttrChangeRequest, Value: []byte{0, 0, 0, change}})
+	}
+	req, err := stun.Build(setters...)
+	if err != nil {
+		return res, err
+	}
+	if _, err = conn.WriteTo(req.Raw, server); err != nil {
+		return res, err
+	}
+
+	buf := make([]byte, 1500)
+	if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return res, err
+	}
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = errNoSTUNResponse
+			}
+			return res, err
+		}
+		msg := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if msg.Decode() != nil || msg.TransactionID != req.TransactionID {
+			continue
+		}
+		var xor stun.XORMappedAddress
+		if err = xor.GetFrom(msg); err != nil {
+			var plain stun.MappedAddress
+			if err = plain.GetFrom(msg); err != nil {
+				return res, err
+			}
+			xor.IP, xor.Port = plain.IP, plain.Port
+		}
+		res.mapped = &net.UDPAddr{IP: xor.IP, Port: xor.Port}
+		res.from, _ = from.(*net.UDPAddr)
+		var otherAddr stun.OtherAddress
+		if otherAddr.GetFrom(msg) == nil {
+			res.other = &net.UDPAddr{IP: otherAddr.IP, Port: otherAddr.Port}
+		}
+		return res, nil
+	}
+}
+
+// isLocalIP reports whether ip belongs to one of our interfaces.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r doctorReport) print(w io.Writer) {
+	yesNo := func(ok bool) string {
+		if ok {
+			return "[green]works"
+		}
+		return "[red]failed"
+	}
+
+	colorstring.Fprintf(w, "[bold]Local candidates:\n")
+	for _, typ := range []string{"host", "srflx", "prflx", "relay", "error"} {
+		for _, c := range r.candidates[typ] {
+			fmt.Fprintf(w, "  %-6s %s\n", typ, c)
+		}
+	}
+	if len(r.candidates) == 0 {
+		fmt.Fprintf(w, "  none\n")
+	}
+
+	colorstring.Fprintf(w, "\n[bold]Public address: [reset]%s\n", strings.Join(r.public, ", "))
+	colorstring.Fprintf(w, "[bold]NAT mapping:    [reset]%s\n", r.mapping)
+	colorstring.Fprintf(w, "[bold]NAT filtering:  [reset]%s\n\n", r.filtering)
+
+	colorstring.Fprintf(w, "[bold]UDP to STUN:    "+yesNo(r.udp)+"\n")
+	var tcp []string
+	for raw := range r.tcp {
+		tcp = append(tcp, raw)
+	}
+	sort.Strings(tcp)
+	for _, raw := range tcp {
+		colorstring.Fprintf(w, "[bold]TCP to %s: "+yesNo(r.tcp[raw] == nil)+"\n", raw)
+	}
+	if r.turn {
+		colorstring.Fprintf(w, "[bold]TURN relay:     "+yesNo(r.relay)+"\n")
+	} else {
+		colorstring.Fprintf(w, "[bold]TURN relay:     [reset]not configured\n")
+	}
+
+	colorstring.Fprintf(w, "\n[bold]Verdict: [reset]%s\n", r.verdict())
+}
+
+func (r doctorReport) verdict() string {
+	var relay string
+	if r.relay {
+		relay = " A TURN relay works, so sessions should still connect through it."
+	} else if !r.turn {
+		relay = " Add a TURN server with -ice for a fallback."
+	}
+	switch {
+	case !r.udp && !r.relay:
+		return "UDP to the STUN servers is blocked and no relay worked, so only peers on the same network can connect. " +
+			"Use a TURN server reachable over TCP (turn:host:port?transport=tcp or turns:), or -tcp-port on the host."
+	case !r.udp:
+		return "UDP to the STUN servers is blocked, so peer-to-peer connections are unlikely." + relay
+	case r.mapping == natNone:
+		return "This machine has a public address, so peer-to-peer connections should work."
+	case r.mapping == natIndependent:
+		return "The NAT keeps the same public port for every destination, so peer-to-peer connections are likely to work."
+	case r.mapping == natAddrPortDependent:
+		return "The NAT uses a new public port for every destination (symmetric NAT), so peer-to-peer only works " +
+			"if the other peer has an open NAT." + relay
+	default:
+		return "Couldn't tell how the NAT maps ports (configure two STUN servers to find out). " +
+			"Peer-to-peer works with most NATs." + relay
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func localTURNServer(t *testing.T) (url string, close func()) {
+	ln, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.LocalAddr().String()
+	ln.Close()
+	server, err := newTURNServer(addr, net.ParseIP("127.0.0.1"), "webtty", turnAuthHandler(nil, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "turn:" + addr, func() { server.Close() }
+}
+
+// withInterfaceAddrs makes addrs the only local addresses for the test.
+func withInterfaceAddrs(t *testing.T, addrs ...string) {
+	var ipNets []net.Addr
+	for _, a := range addrs {
+		ip, ipNet, err := net.ParseCIDR(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipNet.IP = ip
+		ipNets = append(ipNets, ipNet)
+	}
+	interfaceAddrs = func() ([]net.Addr, error) { return ipNets, nil }
+	t.Cleanup(func() { interfaceAddrs = net.InterfaceAddrs })
+}
+
+func TestDoctor(t *testing.T) {
+	// The STUN servers are on loopback, which stands in for the public
+	// internet here.
+	withInterfaceAddrs(t, "192.168.1.2/24")
+	first, closeFirst := localTURNServer(t)
+	defer closeFirst()
+	second, closeSecond := localTURNServer(t)
+	defer closeSecond()
+
+	servers := []webrtc.ICEServer{{URLs: []string{first}}, {URLs: []string{second}}}
+	applyTURNSecret(servers, "secret", time.Hour)
+	report := runDoctor(servers, networkOptions{}, 3*time.Second)
+
+	if !report.udp || !report.relay || !report.turn {
+		t.Errorf("UDP and relay checks should pass: %+v", report)
+	}
+	if report.mapping != natIndependent {
+		t.Error("the same socket should map to the same address", report.mapping, report.public)
+	}
+	if report.filtering != natUnknown {
+		t.Error("filtering needs an RFC 5780 server", report.filtering)
+	}
+	if len(report.candidates["relay"]) == 0 {
+		t.Error("relay candidates should be listed", report.candidates)
+	}
+}
+
+func TestDoctorVerdict(t *testing.T) {
+	for _, tc := range []struct {
+		report doctorReport
+		want   string
+	}{
+		{doctorReport{}, "only peers on the same network"},
+		{doctorReport{relay: true, turn: true}, "relay works"},
+		{doctorReport{udp: true, mapping: natNone}, "public address"},
+		{doctorReport{udp: true, mapping: natIndependent}, "likely to work"},
+		{doctorReport{udp: true, mapping: natAddrPortDependent}, "symmetric NAT"},
+		{doctorReport{udp: true, mapping: natUnknown}, "Couldn't tell"},
+	} {
+		if verdict := tc.report.verdict(); !strings.Contains(verdict, tc.want) {
+			t.Errorf("verdict for %+v should mention %q: %s", tc.report, tc.want, verdict)
+		}
+	}
+}
+
+func TestIsLocalIP(t *testing.T) {
+	withInterfaceAddrs(t, "127.0.0.1/8", "192.168.1.2/24")
+	for ip, want := range map[string]bool{
+		"127.0.0.1":   true,
+		"192.168.1.2": true,
+		"192.168.1.3": false,
+		"203.0.113.1": false,
+	} {
+		if got := isLocalIP(net.ParseIP(ip)); got != want {
+			t.Errorf("isLocalIP(%s) = %t", ip, got)
+		}
+	}
+}
+
+func TestDoctorPrintTCP(t *testing.T) {
+	report := doctorReport{tcp: map[string]error{
+		"turn:c:3478?transport=tcp": nil,
+		"turn:a:3478?transport=tcp": errNoSTUNResponse,
+		"turn:b:3478?transport=tcp": nil,
+	}}
+	var b strings.Builder
+	report.print(&b)
+	last := -1
+	for _, host := range []string{"a", "b", "c"} {
+		i := strings.Index(b.String(), "TCP to turn:"+host)
+		if i < last {
+			t.Errorf("TCP checks should be sorted:\n%s", b.String())
+		}
+		last = i
+	}
+}
+
+func TestSTUNBindingTimeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	_, err = stunBinding(conn, silent.LocalAddr().(*net.UDPAddr), 0, 100*time.Millisecond)
+	if err != errNoSTUNResponse {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// envFeature is listed in the protocol of the client's data channel when it
+// sends its environment. The host then opens a reliable channel labelled
+// "env", so the environment can't be lost however reliable the data channel
+// is. The client sends ["env", "KEY=VALUE", ...] on it and the host waits for
+// it before starting the command. Older hosts never open the channel.
+const envFeature = "env"
+
+// defaultEnv is always sent by clients and accepted by hosts, so programs
+// draw for the client's terminal and speak its language.
+const defaultEnv = "TERM,COLORTERM,LANG,LC_*"
+
+// envWait is how long the host waits for the client's environment before
+// starting the command without it.
+const envWait = 5 * time.Second
+
+var errEnvFormat = errors.New("-env should be KEY=VALUE")
+
+// envFlags collects repeated -env flags.
+type envFlags []string
+
+func (f *envFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *envFlags) Set(value string) error {
+	if i := strings.IndexByte(value, '='); i < 1 {
+		return errEnvFormat
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// envPatterns splits comma separated variable names, which may use shell
+// wildcards like LC_*.
+func envPatterns(lists ...string) (patterns []string) {
+	for _, list := range lists {
+		for _, p := range strings.Split(list, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	return patterns
+}
+
+// matchEnv reports whether the KEY=VALUE variable v is named by one of
+// patterns.
+func matchEnv(patterns []string, v string) bool {
+	name := v
+	if i := strings.IndexByte(v, '='); i >= 0 {
+		name = v[:i]
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEnv returns the variables in environ named by patterns.
+func filterEnv(environ, patterns []string) (vars []string) {
+	for _, v := range environ {
+		if matchEnv(patterns, v) {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// sendEnv sends the client's variables that match -send-env on dc.
+func (cs *clientSession) sendEnv(dc *webrtc.DataChannel) error {
+	msg, err := json.Marshal(append([]string{"env"}, filterEnv(os.Environ(), cs.sendEnvs)...))
+	if err != nil {
+		return err
+	}
+	return dc.SendText(string(msg))
+}
+
+// onDataChannel sends the environment on the "env" channel once the host
+// opens it.
+func (cs *clientSession) onDataChannel() func(dc *webrtc.DataChannel) {
+	return func(dc *webrtc.DataChannel) {
+		if dc.Label() != "env" {
+			return
+		}
+		dc.OnOpen(func() {
+			if err := cs.sendEnv(dc); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+}
+
+// openEnvChannel opens the channel the client sends its environment on.
+func (hs *hostSession) openEnvChannel() error {
+	dc, err := hs.pc.CreateDataChannel("env", nil)
+	if err != nil {
+		return err
+	}
+	dc.OnMessage(hs.envChannelOnMessage())
+	return nil
+}
+
+// envChannelOnMessage passes the client's environment, from the "env"
+// channel, to waitForEnv.
+func (hs *hostSession) envChannelOnMessage() func(p webrtc.DataChannelMessage) {
+	return func(p webrtc.DataChannelMessage) {
+		var msg []string
+		if err := json.Unmarshal(p.Data, &msg); err != nil || len(msg) == 0 {
+			log.Printf("Ignoring %q from the client's env channel", p.Data)
+			return
+		}
+		hs.handleEnvMessage(msg)
+	}
+}
+
+// handleEnvMessage passes the client's ["env", ...] to waitForEnv, keeping
+// only the variables -accept-env allows. It reports whether msg was one.
+func (hs *hostSession) handleEnvMessage(msg []string) bool {
+	if msg[0] != "env" {
+		return false
+	}
+	var vars []string
+	for _, v := range msg[1:] {
+		if strings.IndexByte(v, '=') > 0 && matchEnv(hs.acceptEnv, v) {
+			vars = append(vars, v)
+		} else {
+			log.Printf("Ignoring %q from the client, it isn't in -accept-env", v)
+		}
+	}
+	select {
+	case hs.clientEnv <- vars:
+	default:
+		log.Println("Ignoring a second environment from the client")
+	}
+	return true
+}
+
+// waitForEnv returns the client's environment, if it said it would send one.
+func (hs *hostSession) waitForEnv() []string {
+	if !hs.waitEnv {
+		return nil
+	}
+	select {
+	case vars := <-hs.clientEnv:
+		return vars
+	case <-time.After(envWait):
+		log.Println("The client didn't send its environment, starting without it")
+		return nil
+	}
+}
+
+// command builds the command to run in dir, with the host's environment
+// overridden by the client's and then by -env.
+func (hs *hostSession) command(clientEnv []string) *exec.Cmd {
+	cmd := exec.Command(hs.cmd[0], hs.cmd[1:]...)
+	cmd.Dir = hs.dir
+	// Later values win when a variable is repeated.
+	cmd.Env = append(append(os.Environ(), clientEnv...), hs.env...)
+	return cmd
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvFlags(t *testing.T) {
+	var f envFlags
+	for _, v := range []string{"A=1", "B=", "C=x=y"} {
+		if err := f.Set(v); err != nil {
+			t.Errorf("%q: %s", v, err)
+		}
+	}
+	for _, v := range []string{"A", "=1", ""} {
+		if err := f.Set(v); err != errEnvFormat {
+			t.Errorf("%q should be rejected, got %v", v, err)
+		}
+	}
+	if f.String() != "A=1,B=,C=x=y" {
+		t.Errorf("got %q", f.String())
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	patterns := envPatterns(defaultEnv, " EDITOR, GIT_* ,")
+	environ := []string{
+		"TERM=xterm-256color", "PATH=/bin", "LC_ALL=C", "EDITOR=vi",
+		"GIT_AUTHOR_NAME=me", "HOME=/root", "TERMINFO=/x",
+	}
+	want := []string{"TERM=xterm-256color", "LC_ALL=C", "EDITOR=vi", "GIT_AUTHOR_NAME=me"}
+	if got := filterEnv(environ, patterns); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHandleEnvMessage(t *testing.T) {
+	hs := hostSession{acceptEnv: envPatterns(defaultEnv), clientEnv: make(chan []string, 1), waitEnv: true}
+	if hs.handleEnvMessage([]string{"stdin"}) {
+		t.Error("only env messages should be handled")
+	}
+	if !hs.handleEnvMessage([]string{"env", "TERM=xterm-kitty", "LD_PRELOAD=/evil.so", "LANG"}) {
+		t.Error("env messages should be handled")
+	}
+	hs.handleEnvMessage([]string{"env", "TERM=vt100"})
+	if got := hs.waitForEnv(); !reflect.DeepEqual(got, []string{"TERM=xterm-kitty"}) {
+		t.Errorf("got %q", got)
+	}
+	if (&hostSession{}).waitForEnv() != nil {
+		t.Error("clients that don't send an environment shouldn't be waited for")
+	}
+}
+
+func TestEnvChannel(t *testing.T) {
+	defer os.Setenv("TERM", os.Getenv("TERM"))
+	os.Setenv("TERM", "xterm-kitty")
+	hs := hostSession{acceptEnv: envPatterns(defaultEnv), clientEnv: make(chan []string, 1)}
+	cs := clientSession{sendEnvs: envPatterns("TERM")}
+	connectPeers(t, &hs.session, &cs.session)
+	defer hs.pc.Close()
+	defer cs.pc.Close()
+	cs.pc.OnDataChannel(cs.onDataChannel())
+	if err := hs.openEnvChannel(); err != nil {
+		t.Fatal(err)
+	}
+	hs.waitEnv = true
+	if got := hs.waitForEnv(); !reflect.DeepEqual(got, []string{"TERM=xterm-kitty"}) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webtty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	hs := hostSession{
+		cmd: []string{"sh", "-c", `echo "$TERM $FOO $(pwd -P)"`},
+		dir: dir,
+		env: []string{"FOO=host"},
+	}
+	out, err := hs.command([]string{"TERM=xterm-kitty", "FOO=client"}).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(out)), "xterm-kitty host "+dir; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
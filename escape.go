@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// escapeCommands are the keys that can follow the escape character.
+const escapeCommands = ".?srC"
+
+// escapeFilter finds SSH-style escape sequences in client input: the
+// escape character typed at the start of a line followed by a command key.
+// Typing the escape character twice sends it once. A zero char disables
+// escapes.
+type escapeFilter struct {
+	char      byte
+	lineStart bool
+	pending   bool
+}
+
+func newEscapeFilter(char byte) *escapeFilter {
+	return &escapeFilter{char: char, lineStart: true}
+}
+
+// filter returns the input to forward up to the first command, the command
+// and the input after it.
+func (e *escapeFilter) filter(in []byte) (out []byte, cmd byte, rest []byte) {
+	if e.char == 0 {
+		return in, 0, nil
+	}
+	for i, b := range in {
+		if e.pending {
+			e.pending = false
+			e.lineStart = false
+			switch {
+			case b == e.char:
+				out = append(out, b)
+			case strings.IndexByte(escapeCommands, b) >= 0:
+				return out, b, in[i+1:]
+			default:
+				out = append(out, e.char, b)
+				e.lineStart = b == '\r' || b == '\n'
+			}
+			continue
+		}
+		if e.lineStart && b == e.char {
+			e.pending = true
+			continue
+		}
+		out = append(out, b)
+		e.lineStart = b == '\r' || b == '\n'
+	}
+	return out, 0, nil
+}
+
+// parseEscapeChar reads the -e flag: a single character or "none".
+func parseEscapeChar(value string) (byte, error) {
+	if value == "none" {
+		return 0, nil
+	}
+	if len(value) != 1 {
+		return 0, fmt.Errorf("escape character %q should be a single character or \"none\"", value)
+	}
+	return value[0], nil
+}
+
+func escapeHelp(char byte) string {
+	c := string(char)
+	return strings.Replace("\r\nSupported escape sequences:\r\n"+
+		" ~.   - disconnect\r\n"+
+		" ~C   - open a command line (stats, resize, signal NAME, disconnect)\r\n"+
+		" ~r   - resend the terminal size\r\n"+
+		" ~s   - show connection stats\r\n"+
+		" ~?   - this message\r\n"+
+		" ~~   - send the escape character\r\n"+
+		"(Escapes are only recognized at the start of a line.)\r\n", "~", c, -1)
+}
+
+// commandLine collects the line typed after the ~C escape in raw mode.
+type commandLine struct {
+	buf []byte
+}
+
+// feed adds input and returns what to echo. Once Enter is typed it returns
+// the line and the input after it. Ctrl-C or Escape cancel the line.
+func (c *commandLine) feed(in []byte) (echo []byte, line string, done bool, rest []byte) {
+	for i, b := range in {
+		switch b {
+		case '\r', '\n':
+			line, c.buf = string(c.buf), nil
+			return append(echo, '\r', '\n'), line, true, in[i+1:]
+		case 0x03, 0x1b:
+			c.buf = nil
+			return append(echo, '\r', '\n'), "", true, in[i+1:]
+		case 0x7f, 0x08:
+			if len(c.buf) > 0 {
+				c.buf = c.buf[:len(c.buf)-1]
+				echo = append(echo, "\b \b"...)
+			}
+		default:
+			if b >= 0x20 {
+				c.buf = append(c.buf, b)
+				echo = append(echo, b)
+			}
+		}
+	}
+	return echo, "", false, nil
+}
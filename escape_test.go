@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+// filterAll runs input through e and collects all the commands.
+func filterAll(e *escapeFilter, in []byte) (out, cmds []byte) {
+	for len(in) > 0 {
+		forward, cmd, rest := e.filter(in)
+		out = append(out, forward...)
+		if cmd != 0 {
+			cmds = append(cmds, cmd)
+		}
+		in = rest
+	}
+	return
+}
+
+func TestEscapeFilter(t *testing.T) {
+	for _, tc := range []struct {
+		in, out, cmds string
+	}{
+		{"~s", "", "s"},
+		{"ls\r~s", "ls\r", "s"},
+		{"echo ~s\r", "echo ~s\r", ""},
+		{"~~", "~", ""},
+		{"~x", "~x", ""},
+		{"\r~\r", "\r~\r", ""},
+		{"~.", "", "."},
+		{"~?\r~Cx", "\rx", "?C"},
+	} {
+		out, cmds := filterAll(newEscapeFilter('~'), []byte(tc.in))
+		if string(out) != tc.out || string(cmds) != tc.cmds {
+			t.Errorf("%q: got %q and commands %q, want %q and %q", tc.in, out, cmds, tc.out, tc.cmds)
+		}
+	}
+
+	// The escape character and its command can arrive in separate reads.
+	e := newEscapeFilter('~')
+	if out, _ := filterAll(e, []byte("~")); len(out) != 0 {
+		t.Error("escape character should be held back", out)
+	}
+	if _, cmds := filterAll(e, []byte("s")); string(cmds) != "s" {
+		t.Error("command should be found across reads", cmds)
+	}
+
+	// Input after a command is left for the caller.
+	if _, cmd, rest := newEscapeFilter('~').filter([]byte("~Cstats\r")); cmd != 'C' || string(rest) != "stats\r" {
+		t.Errorf("got command %q and rest %q", cmd, rest)
+	}
+}
+
+func TestEscapeFilterCustomChar(t *testing.T) {
+	out, cmds := filterAll(newEscapeFilter('!'), []byte("~.\r!."))
+	if string(out) != "~.\r" || string(cmds) != "." {
+		t.Errorf("got %q and commands %q", out, cmds)
+	}
+	out, cmds = filterAll(newEscapeFilter(0), []byte("~."))
+	if string(out) != "~." || len(cmds) != 0 {
+		t.Error("escapes should be disabled", out, cmds)
+	}
+}
+
+func TestParseEscapeChar(t *testing.T) {
+	if c, err := parseEscapeChar("none"); c != 0 || err != nil {
+		t.Error("none disables escapes")
+	}
+	if c, err := parseEscapeChar("%"); c != '%' || err != nil {
+		t.Error("single characters are escape characters")
+	}
+	if _, err := parseEscapeChar("ab"); err == nil {
+		t.Error("escape characters are a single character")
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	var c commandLine
+	echo, _, done, _ := c.feed([]byte("statz\x7f"))
+	if done || string(echo) != "statz\b \b" {
+		t.Errorf("unexpected echo %q", echo)
+	}
+	_, line, done, rest := c.feed([]byte("s\rls"))
+	if !done || line != "stats" || string(rest) != "ls" {
+		t.Errorf("got line %q and rest %q", line, rest)
+	}
+	c.feed([]byte("abc"))
+	if _, line, done, _ = c.feed([]byte{0x03}); !done || line != "" {
+		t.Error("ctrl-c should cancel the line")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Output from -exec commands starts with the stream it was written to.
+const (
+	streamStdout byte = 1
+	streamStderr byte = 2
+)
+
+// drainTimeout is how long the client waits for its last messages to reach
+// the host before exiting.
+const drainTimeout = 5 * time.Second
+
+var errTrickleExec = errors.New("trickle ICE sends candidates over stdin and stdout, which -exec sessions use for data")
+
+// exitStatus is returned by join when an -exec command exits with a non-zero
+// status, so the client can exit with it too.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("command exited with status %d", int(s))
+}
+
+// exitCode reads a status from cmd.Wait, using 128 plus the signal number
+// for commands that were killed, like a shell does.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// runExec runs cmd with pipes instead of a terminal, for -exec
+// sessions. Output is sent tagged with the stream it came from until the
+// command closes both, then ["eof"] and ["exit", status] once it exits.
+// The session ends when the client acknowledges the status, so nothing
+// queued for it is lost. Input from the client goes to the command's stdin,
+// which is closed when the client sends ["eof"].
+func (hs *hostSession) runExec(cmd *exec.Cmd) {
+	// Its own process group, so limits can kill everything it started.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Println(err)
+		hs.errChan <- err
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Println(err)
+		hs.errChan <- err
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Println(err)
+		hs.errChan <- err
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		log.Println(err)
+		hs.errChan <- err
+		return
+	}
+	rc := &runningCommand{process: cmd.Process, stdin: stdin, exitAcked: make(chan struct{})}
+	hs.started.Store(rc)
+	hs.watch(cmd.Process)
+
+	var wg sync.WaitGroup
+	for tag, r := range map[byte]io.Reader{streamStdout: stdout, streamStderr: stderr} {
+		wg.Add(1)
+		go func(r io.Reader, tag byte) {
+			defer wg.Done()
+			err := readBatches(r, hs.readSize, hs.batchWindow, func(p []byte) error {
+				return hs.flow.send(append([]byte{tag}, p...))
+			})
+			if err != io.EOF {
+				log.Println(err)
+			}
+		}(r, tag)
+	}
+	// Wait closes the pipes, so only once they have been read.
+	wg.Wait()
+	if err = hs.dc.SendText(`["eof"]`); err != nil {
+		log.Println(err)
+	}
+	status := exitCode(cmd.Wait())
+	if err = hs.dc.SendText(`["exit","` + strconv.Itoa(status) + `"]`); err != nil {
+		log.Println(err)
+	}
+	hs.waitForExitAck(rc.exitAcked)
+	err = nil
+	if reason, ok := hs.endReason.Load().(error); ok {
+		err = reason
+	}
+	select {
+	case hs.errChan <- err:
+	default:
+	}
+}
+
+// waitForExitAck waits until the client has received ["exit"], and
+// everything sent before it, or the data channel closes. A client that
+// disappears is caught by the heartbeat.
+func (hs *hostSession) waitForExitAck(acked chan struct{}) {
+	for {
+		select {
+		case <-acked:
+			return
+		case <-time.After(100 * time.Millisecond):
+			if hs.dc.ReadyState() != webrtc.DataChannelStateOpen {
+				return
+			}
+		}
+	}
+}
+
+// writeInput writes input from the client to the terminal, or the
+// command's stdin in -exec sessions.
+func (hs *hostSession) writeInput(p []byte) error {
+	if rc := hs.running(); rc != nil && rc.stdin != nil {
+		_, err := rc.stdin.Write(p)
+		return err
+	}
+	_, err := hs.ptmx.Write(p)
+	return err
+}
+
+// handleExecMessage handles the client's ["eof"] and ["exit_ack"]. It
+// reports whether msg was one of them.
+func (hs *hostSession) handleExecMessage(msg []string) bool {
+	rc := hs.running()
+	switch msg[0] {
+	case "eof":
+		if rc != nil && rc.stdin != nil {
+			if err := rc.stdin.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+		return true
+	case "exit_ack":
+		if rc != nil && rc.exitAcked != nil {
+			select {
+			case <-rc.exitAcked:
+			default:
+				close(rc.exitAcked)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// execOnOpen streams stdin to the host for -exec sessions, and sends
+// ["eof"] when it ends. The terminal is left alone so the client works in
+// pipes and scripts.
+func (cs *clientSession) execOnOpen() {
+	go cs.forwardSignals()
+	if cs.stats {
+		go cs.watchStats(cs.dc, cs.showStats)
+	}
+	err := readBatches(os.Stdin, cs.readSize, cs.batchWindow, cs.send)
+	if err != io.EOF {
+		log.Println(err)
+		cs.errChan <- err
+		return
+	}
+	if err = cs.dc.SendText(`["eof"]`); err != nil {
+		log.Println(err)
+		cs.errChan <- err
+	}
+}
+
+// drain waits until everything sent on dc has reached the other side, the
+// channel closes or timeout passes.
+func drain(dc *webrtc.DataChannel, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for dc.BufferedAmount() > 0 && dc.ReadyState() == webrtc.DataChannelStateOpen &&
+		time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeOutput writes tagged output from an -exec command to stdout or
+// stderr.
+func (cs *clientSession) writeOutput(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	out := os.Stdout
+	if data[0] == streamStderr {
+		out = os.Stderr
+	}
+	_, err := out.Write(data[1:])
+	return err
+}
+
+// handleExecMessage handles ["eof"] and ["exit", status] from the host. The
+// exit status is acknowledged, and the client ends once the host has the
+// acknowledgement. It reports whether msg was one of them.
+func (cs *clientSession) handleExecMessage(msg []string) bool {
+	switch msg[0] {
+	case "eof":
+		return true
+	case "exit":
+		status := 1
+		if len(msg) > 1 {
+			var err error
+			if status, err = strconv.Atoi(msg[1]); err != nil {
+				log.Println(err)
+				status = 1
+			}
+		}
+		var err error
+		if status != 0 {
+			err = exitStatus(status)
+		}
+		go func() {
+			if err := cs.dc.SendText(`["exit_ack"]`); err != nil {
+				log.Println(err)
+			}
+			drain(cs.dc, drainTimeout)
+			select {
+			case cs.errChan <- err:
+			default:
+			}
+		}()
+		return true
+	}
+	return false
+}
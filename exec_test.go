@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestExitCode(t *testing.T) {
+	for script, want := range map[string]int{
+		"exit 0":      0,
+		"exit 3":      3,
+		"kill -9 $$":  128 + 9,
+		"kill -15 $$": 128 + 15,
+	} {
+		if got := exitCode(exec.Command("sh", "-c", script).Run()); got != want {
+			t.Errorf("%s: got %d, want %d", script, got, want)
+		}
+	}
+	if exitStatus(3).Error() != "command exited with status 3" {
+		t.Error(exitStatus(3))
+	}
+}
+
+func TestRunExec(t *testing.T) {
+	hs := hostSession{
+		cmd:      []string{"sh", "-c", "tr a-z A-Z; echo done >&2; exit 3"},
+		execMode: true,
+	}
+	var client session
+	hostDC, clientDC := connectPeers(t, &hs.session, &client)
+	defer hs.pc.Close()
+	defer client.pc.Close()
+	hs.errChan = make(chan error, 1)
+	hs.dc = hostDC
+	hs.flow = newOutputFlow(hostDC, false)
+	hostDC.OnMessage(hs.dataChannelOnMessage())
+
+	var mu sync.Mutex
+	var stdout, stderr string
+	var control []string
+	exited := make(chan struct{})
+	clientDC.OnMessage(func(msg webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !msg.IsString {
+			switch msg.Data[0] {
+			case streamStdout:
+				stdout += string(msg.Data[1:])
+			case streamStderr:
+				stderr += string(msg.Data[1:])
+			}
+			return
+		}
+		if len(control) == 0 && (stdout != "HELLO\n" || stderr != "done\n") {
+			t.Errorf("%s sent before all the output, got %q and %q", msg.Data, stdout, stderr)
+		}
+		control = append(control, string(msg.Data))
+		if strings.HasPrefix(string(msg.Data), `["exit"`) {
+			close(exited)
+			clientDC.SendText(`["exit_ack"]`)
+		}
+	})
+	go hs.runExec(hs.command(nil))
+	clientDC.Send([]byte("hello\n"))
+	clientDC.SendText(`["eof"]`)
+
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the command didn't exit after stdin was closed")
+	}
+	if err := <-hs.errChan; err != nil {
+		t.Error(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(control, " "); got != `["eof"] ["exit","3"]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+// TestExecSessionEnd runs the host only as long as a real one lives: its
+// connection is closed as soon as the session ends. All the output and the
+// exit status must have reached the client by then.
+func TestExecSessionEnd(t *testing.T) {
+	stdout, stderr := os.Stdout, os.Stderr
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	os.Stdout, os.Stderr = tmpFile(), tmpFile()
+
+	const size = 4 << 20
+	hs := hostSession{
+		cmd:      []string{"sh", "-c", fmt.Sprintf("head -c %d /dev/zero; exit 3", size)},
+		execMode: true,
+	}
+	cs := clientSession{}
+	cs.offer.Exec = true
+	hostDC, clientDC := connectPeers(t, &hs.session, &cs.session)
+	defer cs.pc.Close()
+	hs.errChan = make(chan error, 1)
+	cs.errChan = make(chan error, 1)
+	hs.dc, cs.dc = hostDC, clientDC
+	hs.flow = newOutputFlow(hostDC, false)
+	hostDC.OnMessage(hs.dataChannelOnMessage())
+	clientDC.OnMessage(cs.dataChannelOnMessage())
+
+	go func() {
+		if err := <-hs.errChan; err != nil {
+			t.Error(err)
+		}
+		hs.pc.Close()
+	}()
+	go hs.runExec(hs.command(nil))
+	clientDC.SendText(`["eof"]`)
+
+	select {
+	case err := <-cs.errChan:
+		if err != exitStatus(3) {
+			t.Errorf("got %v, want exit status 3", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("the client didn't get the exit status")
+	}
+	if info, err := os.Stdout.Stat(); err != nil || info.Size() != size {
+		t.Errorf("got %v bytes of %d, %v", info.Size(), size, err)
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	stdout, stderr := os.Stdout, os.Stderr
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	os.Stdout, os.Stderr = tmpFile(), tmpFile()
+
+	cs := clientSession{}
+	for _, msg := range [][]byte{
+		append([]byte{streamStdout}, "out "...),
+		append([]byte{streamStderr}, "err"...),
+		append([]byte{streamStdout}, "put"...),
+		{},
+	} {
+		if err := cs.writeOutput(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for f, want := range map[*os.File]string{os.Stdout: "out put", os.Stderr: "err"} {
+		f.Seek(0, 0)
+		if got, _ := ioutil.ReadAll(f); string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
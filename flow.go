@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// maxBuffered is how much output can wait to be sent before the host
+	// stops reading the pty, or starts dropping output.
+	maxBuffered = 1 << 20
+	// lowBuffered is where sending resumes.
+	lowBuffered = 256 << 10
+	// maxCoalesced is how much of the latest output is kept for a client
+	// that has fallen behind with -slow-client drop.
+	maxCoalesced = 32 << 10
+)
+
+// outputFlow sends output from the pty without queueing more than
+// maxBuffered on the data channel. When the client falls behind, send
+// either blocks until it catches up, which stops the pty being read and so
+// pauses the command, or keeps the latest output and drops the rest.
+type outputFlow struct {
+	mu      sync.Mutex
+	dc      *webrtc.DataChannel
+	drop    bool
+	low     chan struct{}
+	pending []byte
+	dropped int
+
+	// sendMu keeps compressed messages in the order they were compressed.
+	sendMu  sync.Mutex
+	deflate *deflater
+}
+
+func newOutputFlow(dc *webrtc.DataChannel, drop bool) *outputFlow {
+	f := &outputFlow{dc: dc, drop: drop, low: make(chan struct{}, 1)}
+	dc.SetBufferedAmountLowThreshold(lowBuffered)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case f.low <- struct{}{}:
+		default:
+		}
+		if f.drop {
+			// Not on the SCTP read loop that calls us.
+			go func() {
+				if err := f.flush(); err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+	})
+	return f
+}
+
+func (f *outputFlow) send(p []byte) error {
+	if !f.drop {
+		f.wait()
+		return f.write(p)
+	}
+	f.mu.Lock()
+	if len(f.pending) == 0 && f.dc.BufferedAmount() <= maxBuffered {
+		// Still locked, so a flush can't add to the buffer in between.
+		err := f.write(p)
+		f.mu.Unlock()
+		return err
+	}
+	f.pending = append(f.pending, p...)
+	if over := len(f.pending) - maxCoalesced; over > 0 {
+		// Start from a new line where we can, so less of a cut escape
+		// sequence is left behind.
+		cut := over
+		if i := bytes.IndexByte(f.pending[over:], '\n'); i >= 0 && i < maxCoalesced/2 {
+			cut += i + 1
+		}
+		f.dropped += cut
+		f.pending = append([]byte(nil), f.pending[cut:]...)
+	}
+	f.mu.Unlock()
+	if f.dc.BufferedAmount() <= lowBuffered {
+		return f.flush()
+	}
+	return nil
+}
+
+// wait blocks once more than maxBuffered is queued, until the data channel
+// has drained to lowBuffered.
+func (f *outputFlow) wait() {
+	if f.dc.BufferedAmount() <= maxBuffered {
+		return
+	}
+	for f.dc.BufferedAmount() > lowBuffered && f.dc.ReadyState() == webrtc.DataChannelStateOpen {
+		select {
+		case <-f.low:
+		case <-time.After(time.Second):
+			// In case the channel closed.
+		}
+	}
+}
+
+// flush sends the output kept while the client was behind, after a note
+// saying how much was dropped. It waits for the next low buffer if the
+// channel filled up again before it ran.
+func (f *outputFlow) flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.pending) == 0 || f.dc.BufferedAmount() > lowBuffered {
+		return nil
+	}
+	if f.dropped > 0 {
+		notice := fmt.Sprintf("\r\n\x1b[0m\x1b[1m[webtty] Skipped %s of output while the connection caught up.\x1b[0m\r\n",
+			humanBytes(uint64(f.dropped)))
+		if err := f.write([]byte(notice)); err != nil {
+			return err
+		}
+	}
+	err := f.write(f.pending)
+	f.pending, f.dropped = nil, 0
+	return err
+}
+
+// startCompressing tells the client that output is compressed from here on.
+func (f *outputFlow) startCompressing() error {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if err := f.dc.SendText(compressMessage); err != nil {
+		return err
+	}
+	f.deflate = newDeflater()
+	return nil
+}
+
+// write sends p straight away, compressed if the client asked for it.
+func (f *outputFlow) write(p []byte) (err error) {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if f.deflate != nil {
+		if p, err = f.deflate.compress(p); err != nil {
+			return err
+		}
+	}
+	return f.dc.Send(p)
+}
+
+// parseSlowClient reads the -slow-client flag and reports whether output
+// should be dropped.
+func parseSlowClient(mode string) (drop bool, err error) {
+	switch mode {
+	case "pause":
+		return false, nil
+	case "drop":
+		return true, nil
+	}
+	return false, fmt.Errorf("-slow-client should be \"pause\" or \"drop\", not %q", mode)
+}
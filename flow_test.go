@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// floodClient sends n chunks of output through an outputFlow to a client
+// that collects them, and returns what the client received.
+func floodClient(t *testing.T, drop bool, n int) []byte {
+	var host, client session
+	hostDC, clientDC := connectPeers(t, &host, &client)
+	defer host.pc.Close()
+	defer client.pc.Close()
+
+	var mu sync.Mutex
+	var received []byte
+	done := make(chan struct{})
+	clientDC.OnMessage(func(msg webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, msg.Data...)
+		if bytes.HasSuffix(received, []byte("END")) {
+			close(done)
+		}
+	})
+
+	flow := newOutputFlow(hostDC, drop)
+	chunk := bytes.Repeat([]byte("0123456789abcdef\n"), 60)
+	for i := 0; i < n; i++ {
+		if err := flow.send(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if buffered := hostDC.BufferedAmount(); buffered > maxBuffered+uint64(len(chunk)) {
+			t.Fatalf("%d bytes buffered", buffered)
+		}
+	}
+	if err := flow.send([]byte("END")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("output didn't arrive")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return received
+}
+
+func TestOutputFlowPause(t *testing.T) {
+	received := floodClient(t, false, 8000)
+	if want := 8000*60*17 + 3; len(received) != want {
+		t.Errorf("received %d bytes, want %d", len(received), want)
+	}
+}
+
+func TestOutputFlowDrop(t *testing.T) {
+	received := floodClient(t, true, 8000)
+	if len(received) >= 8000*60*17 {
+		t.Skip("the client kept up, nothing was dropped")
+	}
+	if !bytes.Contains(received, []byte("[webtty] Skipped")) {
+		t.Error("the client should be told output was dropped")
+	}
+}
+
+func TestParseSlowClient(t *testing.T) {
+	if drop, err := parseSlowClient("drop"); err != nil || !drop {
+		t.Error(drop, err)
+	}
+	if drop, err := parseSlowClient("pause"); err != nil || drop {
+		t.Error(drop, err)
+	}
+	if _, err := parseSlowClient("wait"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// signals are the signals a client can send to the host's command.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+}
+
+var errNoCommand = errors.New("the command isn't running")
+
+// parseSignal reads a signal name like TERM, SIGTERM or term.
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// signalName is the name parseSignal reads for sig.
+func signalName(sig os.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return ""
+}
+
+// handleSignalMessage sends the signal in ["signal", name] to the command.
+// It reports whether msg was a signal message.
+func (hs *hostSession) handleSignalMessage(msg []string) bool {
+	if msg[0] != "signal" || len(msg) < 2 {
+		return false
+	}
+	sig, err := parseSignal(msg[1])
+	if err == nil {
+		log.Printf("Sending SIG%s from the client\n", msg[1])
+		err = hs.signalCommand(sig)
+	}
+	if err != nil {
+		log.Println(err)
+		hs.notify(fmt.Sprintf("Couldn't send SIG%s: %s", strings.TrimPrefix(strings.ToUpper(msg[1]), "SIG"), err))
+	}
+	return true
+}
+
+// signalCommand sends sig to the terminal's foreground process group, the
+// job the client is looking at, like typing Ctrl-C does. -exec commands,
+// which have no terminal, get it in their own process group.
+func (hs *hostSession) signalCommand(sig syscall.Signal) error {
+	rc := hs.running()
+	if rc == nil || rc.process == nil {
+		return errNoCommand
+	}
+	pgid := rc.process.Pid
+	if hs.ptmx != nil {
+		if fg, err := foregroundGroup(hs.ptmx); err == nil && fg > 0 {
+			pgid = fg
+		}
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+// foregroundGroup asks a terminal for its foreground process group.
+func foregroundGroup(tty *os.File) (int, error) {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(),
+		uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+// sendSignal asks the host to send a signal to the command.
+func (cs *clientSession) sendSignal(name string) error {
+	if _, err := parseSignal(name); err != nil {
+		return err
+	}
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	return cs.dc.SendText(`["signal","` + name + `"]`)
+}
+
+// forwardSignals passes SIGINT, SIGQUIT, SIGTERM and SIGHUP sent to the
+// client on to the command. A second one disconnects, in case the host
+// isn't listening.
+func (cs *clientSession) forwardSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+	forwarded := false
+	for sig := range ch {
+		if forwarded {
+			select {
+			case cs.errChan <- fmt.Errorf("disconnected after a second %s", sig):
+			default:
+			}
+			return
+		}
+		forwarded = true
+		if err := cs.sendSignal(signalName(sig)); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+)
+
+func TestParseSignal(t *testing.T) {
+	for _, name := range []string{"TERM", "SIGTERM", "term", "sigterm"} {
+		if sig, err := parseSignal(name); err != nil || sig != syscall.SIGTERM {
+			t.Errorf("parseSignal(%q) = %v, %v", name, sig, err)
+		}
+	}
+	if _, err := parseSignal("SEGV"); err == nil {
+		t.Error("only the listed signals can be sent")
+	}
+	if name := signalName(syscall.SIGHUP); name != "HUP" {
+		t.Errorf("got %q", name)
+	}
+}
+
+// waitStatus waits for cmd and returns its exit status.
+func waitStatus(t *testing.T, cmd *exec.Cmd) int {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return exitCode(err)
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("the signal wasn't delivered")
+	}
+	return 0
+}
+
+func TestSignalExecCommand(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	hs := hostSession{}
+	hs.started.Store(&runningCommand{process: cmd.Process})
+	if !hs.handleSignalMessage([]string{"signal", "TERM"}) {
+		t.Error("signal messages should be handled")
+	}
+	if status := waitStatus(t, cmd); status != 128+int(syscall.SIGTERM) {
+		t.Errorf("got status %d", status)
+	}
+}
+
+func TestSignalTerminalCommand(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptmx.Close()
+	hs := hostSession{ptmx: ptmx}
+	hs.started.Store(&runningCommand{process: cmd.Process})
+	if err := hs.signalCommand(syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	if status := waitStatus(t, cmd); status != 128+int(syscall.SIGINT) {
+		t.Errorf("got status %d", status)
+	}
+}
+
+func TestSignalErrors(t *testing.T) {
+	hs := hostSession{}
+	if err := hs.signalCommand(syscall.SIGTERM); err != errNoCommand {
+		t.Error(err)
+	}
+	if !hs.handleSignalMessage([]string{"signal", "NOPE"}) {
+		t.Error("unknown signals are still signal messages")
+	}
+	if hs.handleSignalMessage([]string{"stdin", "x"}) {
+		t.Error("only signal messages should be handled")
+	}
+}
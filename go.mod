@@ -3,9 +3,16 @@ module github.com/maxmcd/webtty
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/btcsuite/btcutil v0.0.0-20190316010144-3ac1210f4b38
+	github.com/grandcat/zeroconf v1.0.0
+	github.com/hinshun/vt10x v0.0.0-20220301184237-5011da428d02
 	github.com/kr/pty v1.1.4
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db
+	github.com/pion/ice/v2 v2.2.3
+	github.com/pion/stun v0.3.5
+	github.com/pion/turn/v2 v2.0.8
 	github.com/pion/webrtc/v3 v3.1.29
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4
 )
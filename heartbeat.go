@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// maxHeartbeatInterval is how often peers ping each other, unless the peer
+// timeout is short enough to need more frequent pings.
+const maxHeartbeatInterval = 5 * time.Second
+
+// heartbeatFeature is listed in the protocol of the client's data channel
+// when it answers pings. Only then does the host ping it, and the client only
+// pings hosts that have pinged it, so older peers never see a ping.
+const heartbeatFeature = "heartbeat"
+
+var errPeerTimeout = errors.New("connection lost: nothing heard from the other side, " +
+	"it may have gone to sleep or lost its network")
+
+// seen records that the peer is alive. Every message counts.
+func (s *session) seen() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+// heartbeat pings the peer and reports errPeerTimeout when nothing has been
+// heard from it for s.peerTimeout. A zero timeout disables it.
+func (s *session) heartbeat(send func(string) error) {
+	if s.peerTimeout <= 0 {
+		return
+	}
+	interval := s.peerTimeout / 3
+	if interval > maxHeartbeatInterval {
+		interval = maxHeartbeatInterval
+	}
+	s.seen()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		lastSeen := time.Unix(0, atomic.LoadInt64(&s.lastSeen))
+		if time.Since(lastSeen) > s.peerTimeout {
+			select {
+			case s.errChan <- errPeerTimeout:
+			default:
+			}
+			return
+		}
+		if err := send(fmt.Sprintf(`["ping","%d"]`, time.Now().UnixNano())); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// startHeartbeat starts heartbeat, once.
+func (s *session) startHeartbeat(send func(string) error) {
+	s.heartbeatOnce.Do(func() { go s.heartbeat(send) })
+}
+
+// handleHeartbeat answers pings and measures latency from pongs. A ping
+// shows the peer knows about heartbeats, so it's pinged back. It reports
+// whether msg was a heartbeat message.
+func (s *session) handleHeartbeat(msg []string, send func(string) error) bool {
+	if len(msg) != 2 {
+		return false
+	}
+	switch msg[0] {
+	case "ping":
+		if err := send(`["pong",` + strconv.Quote(msg[1]) + `]`); err != nil {
+			log.Println(err)
+		}
+		s.startHeartbeat(send)
+		return true
+	case "pong":
+		sent, err := strconv.ParseInt(msg[1], 10, 64)
+		if err != nil {
+			log.Println(err)
+			return true
+		}
+		atomic.StoreInt64(&s.latency, time.Now().UnixNano()-sent)
+		return true
+	}
+	return false
+}
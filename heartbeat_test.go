@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatTimeout(t *testing.T) {
+	s := session{peerTimeout: 300 * time.Millisecond, errChan: make(chan error, 1)}
+	pings := make(chan string, 10)
+	go s.heartbeat(func(msg string) error {
+		pings <- msg
+		return nil
+	})
+
+	select {
+	case err := <-s.errChan:
+		if err != errPeerTimeout {
+			t.Error("expected a peer timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("heartbeat should time out when nothing is heard")
+	}
+	if len(pings) == 0 || !strings.HasPrefix(<-pings, `["ping","`) {
+		t.Error("heartbeat should ping the peer")
+	}
+}
+
+func TestHeartbeatKeepsAlive(t *testing.T) {
+	s := session{peerTimeout: 300 * time.Millisecond, errChan: make(chan error, 1)}
+	go s.heartbeat(func(string) error {
+		s.seen()
+		return nil
+	})
+	select {
+	case err := <-s.errChan:
+		t.Error("a responsive peer shouldn't time out", err)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestPingStartsHeartbeat(t *testing.T) {
+	s := session{peerTimeout: 300 * time.Millisecond, errChan: make(chan error, 1)}
+	pings := make(chan string, 10)
+	send := func(msg string) error {
+		pings <- msg
+		return nil
+	}
+	select {
+	case err := <-s.errChan:
+		t.Fatal("peers that never pinged shouldn't be pinged", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	s.handleHeartbeat([]string{"ping", "42"}, send)
+	s.handleHeartbeat([]string{"ping", "43"}, send)
+	select {
+	case err := <-s.errChan:
+		if err != errPeerTimeout {
+			t.Error("expected a peer timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a ping should start the heartbeat")
+	}
+	var sent []string
+	for len(pings) > 0 {
+		sent = append(sent, <-pings)
+	}
+	if len(sent) < 3 || !strings.HasPrefix(sent[2], `["ping","`) {
+		t.Error("the peer should be pinged back", sent)
+	}
+}
+
+func TestHandleHeartbeat(t *testing.T) {
+	var s session
+	var sent string
+	send := func(msg string) error {
+		sent = msg
+		return nil
+	}
+	if !s.handleHeartbeat([]string{"ping", "42"}, send) || sent != `["pong","42"]` {
+		t.Error("pings should be answered", sent)
+	}
+	ping := time.Now().Add(-20 * time.Millisecond).UnixNano()
+	if !s.handleHeartbeat([]string{"pong", strconv.FormatInt(ping, 10)}, send) {
+		t.Error("pongs are heartbeat messages")
+	}
+	if latency := time.Duration(atomic.LoadInt64(&s.latency)); latency < 20*time.Millisecond || latency > time.Second {
+		t.Error("unexpected latency", latency)
+	}
+	if s.handleHeartbeat([]string{"stdin", "ls"}, send) {
+		t.Error("other messages aren't heartbeats")
+	}
+}
@@ -7,8 +7,9 @@ import (
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/kr/pty"
@@ -18,20 +19,84 @@ import (
 )
 
 type hostSession struct {
+	// lastInput is when the client last typed, for idleTimeout. Accessed
+	// atomically, first in the struct for 64-bit alignment.
+	lastInput int64
+
 	session
 	cmd            []string
 	nonInteractive bool
 	oneWay         bool
 	ptmx           *os.File
-	ptmxReady      bool
+	started        atomic.Value
 	tmux           bool
+	offerTTL       time.Duration
+	qr             bool
+	trickleICE     bool
+	lan            bool
+	logStats       bool
+	idleTimeout    time.Duration
+	maxDuration    time.Duration
+	endReason      atomic.Value
+	syncMode       bool
+	screen         *screenSync
+	syncDC         atomic.Value
+	dropOutput     bool
+	flow           *outputFlow
+	compress       bool
+	compressOffer  bool
+	heartbeatOffer bool
+	inflate        *inflater
+	execMode       bool
+	offerExpires   time.Time
+	dir            string
+	env            []string
+	acceptEnv      []string
+	clientEnv      chan []string
+	waitEnv        bool
+}
+
+// runningCommand is stored in hostSession.started once the command is
+// running. Messages from the client are handled on another goroutine, which
+// waits for it.
+type runningCommand struct {
+	process *os.Process
+	// stdin is the command's stdin in -exec sessions.
+	stdin io.WriteCloser
+	// exitAcked is closed when the client has the exit status of an -exec
+	// command.
+	exitAcked chan struct{}
 }
 
+// running returns the started command, or nil before it starts.
+func (hs *hostSession) running() *runningCommand {
+	rc, _ := hs.started.Load().(*runningCommand)
+	return rc
+}
+
+var (
+	errTrickleOneWay = errors.New("trickle ICE needs a live signaling channel and can't be used with one-way connections")
+)
+
 func (hs *hostSession) dataChannelOnOpen() func() {
 	return func() {
 		colorstring.Println("[bold]Terminal session started:")
 
-		cmd := exec.Command(hs.cmd[0], hs.cmd[1:]...)
+		// Dropping output would corrupt the data an -exec command sends.
+		hs.flow = newOutputFlow(hs.dc, hs.dropOutput && !hs.execMode)
+		if hs.compress && hs.compressOffer {
+			if err := hs.flow.startCompressing(); err != nil {
+				log.Println(err)
+				hs.errChan <- err
+				return
+			}
+		}
+		cmd := hs.command(hs.waitForEnv())
+		if hs.execMode {
+			hs.runExec(cmd)
+			return
+		}
+
 		var err error
 		hs.ptmx, err = pty.Start(cmd)
 		if err != nil {
@@ -39,7 +104,12 @@ func (hs *hostSession) dataChannelOnOpen() func() {
 			hs.errChan <- err
 			return
 		}
-		hs.ptmxReady = true
+		if hs.syncMode {
+			hs.screen = newScreenSync(hs.ptmx)
+			go hs.streamScreen()
+		}
+		hs.started.Store(&runningCommand{process: cmd.Process})
+		hs.watch(cmd.Process)
 
 		if !hs.nonInteractive {
 			if err = hs.makeRawTerminal(); err != nil {
@@ -48,57 +118,69 @@ func (hs *hostSession) dataChannelOnOpen() func() {
 				return
 			}
 			go func() {
+				hs.waitForSignaling()
 				if _, err = io.Copy(hs.ptmx, os.Stdin); err != nil {
 					log.Println(err)
 				}
 			}()
 		}
 
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			for range c {
-				log.Println("Sigint")
-				hs.errChan <- errors.New("sigint")
-			}
-		}()
-
-		buf := make([]byte, 1024)
-		for {
-			nr, err := hs.ptmx.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					err = nil
-				} else {
-					log.Println(err)
+		err = readBatches(hs.ptmx, hs.readSize, hs.batchWindow, func(out []byte) error {
+			if !hs.nonInteractive {
+				if _, err := os.Stdout.Write(out); err != nil {
+					return err
 				}
-				hs.errChan <- err
-				return
 			}
-			if !hs.nonInteractive {
-				if _, err = os.Stdout.Write(buf[0:nr]); err != nil {
+			if hs.screen != nil {
+				if _, err := hs.screen.Write(out); err != nil {
 					log.Println(err)
-					hs.errChan <- err
-					return
 				}
+				return nil
 			}
-			if err = hs.dc.Send(buf[0:nr]); err != nil {
-				log.Println(err)
-				hs.errChan <- err
-				return
-			}
+			return hs.flow.send(out)
+		})
+		if reason, ok := hs.endReason.Load().(error); ok {
+			err = reason
+		} else if err == io.EOF {
+			err = nil
+		} else {
+			log.Println(err)
 		}
+		hs.errChan <- err
 	}
 }
 
+// watch starts the goroutines that look after a running command.
+func (hs *hostSession) watch(process *os.Process) {
+	go hs.enforceLimits(process)
+	if hs.heartbeatOffer {
+		hs.startHeartbeat(hs.dc.SendText)
+	}
+	if hs.logStats {
+		go hs.watchStats(hs.dc, func(stats connStats) {
+			log.Printf("Stats: %s\n", stats)
+		})
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		for range c {
+			log.Println("Sigint")
+			hs.errChan <- errors.New("sigint")
+		}
+	}()
+}
+
 func (hs *hostSession) dataChannelOnMessage() func(payload webrtc.DataChannelMessage) {
 	return func(p webrtc.DataChannelMessage) {
 
 		// OnMessage can fire before onOpen
 		// Let's wait for the pty session to be ready
-		for hs.ptmxReady != true {
+		for hs.running() == nil {
 			time.Sleep(1 * time.Millisecond)
 		}
+		hs.seen()
 
 		if p.IsString {
 			if len(p.Data) > 2 && p.Data[0] == '[' && p.Data[1] == '"' {
@@ -108,19 +190,32 @@ func (hs *hostSession) dataChannelOnMessage() func(payload webrtc.DataChannelMes
 					log.Println(err)
 					hs.errChan <- err
 				}
+				if hs.handleHeartbeat(msg, hs.dc.SendText) || hs.handleExecMessage(msg) ||
+					hs.handleSignalMessage(msg) {
+					return
+				}
+				if msg[0] == "compress" && len(msg) > 1 && msg[1] == compressFeature {
+					// Input from the client is compressed from here on.
+					hs.inflate = &inflater{}
+					return
+				}
 				if msg[0] == "stdin" {
 					toWrite := []byte(msg[1])
 					if len(toWrite) == 0 {
 						return
 					}
-					_, err := hs.ptmx.Write([]byte(msg[1]))
-					if err != nil {
+					hs.touch()
+					if err := hs.writeInput(toWrite); err != nil {
 						log.Println(err)
 						hs.errChan <- err
 					}
 					return
 				}
 				if msg[0] == "set_size" {
+					if hs.ptmx == nil {
+						// -exec commands have no terminal.
+						return
+					}
 					var size []int
 					_ = json.Unmarshal(p.Data, &size)
 					ws, err := pty.GetsizeFull(hs.ptmx)
@@ -141,6 +236,18 @@ func (hs *hostSession) dataChannelOnMessage() func(payload webrtc.DataChannelMes
 						log.Println(err)
 						hs.errChan <- err
 					}
+					if hs.screen != nil {
+						hs.screen.resize(int(ws.Cols), int(ws.Rows))
+					}
+					return
+				}
+				if msg[0] == "ack" && hs.screen != nil && len(msg) > 1 {
+					num, err := strconv.ParseUint(msg[1], 10, 32)
+					if err != nil {
+						log.Println(err)
+						return
+					}
+					hs.screen.ack(uint32(num))
 					return
 				}
 			}
@@ -153,8 +260,17 @@ func (hs *hostSession) dataChannelOnMessage() func(payload webrtc.DataChannelMes
 				string(p.Data),
 			)
 		} else {
-			_, err := hs.ptmx.Write(p.Data)
-			if err != nil {
+			hs.touch()
+			data := p.Data
+			if hs.inflate != nil {
+				var err error
+				if data, err = hs.inflate.decompress(data); err != nil {
+					log.Println(err)
+					hs.errChan <- err
+					return
+				}
+			}
+			if err := hs.writeInput(data); err != nil {
 				log.Println(err)
 				hs.errChan <- err
 			}
@@ -164,7 +280,22 @@ func (hs *hostSession) dataChannelOnMessage() func(payload webrtc.DataChannelMes
 
 func (hs *hostSession) onDataChannel() func(dc *webrtc.DataChannel) {
 	return func(dc *webrtc.DataChannel) {
+		if dc.Label() == "sync" {
+			// Screen updates for -sync clients, the host only sends on it.
+			hs.syncDC.Store(dc)
+			return
+		}
 		hs.dc = dc
+		hs.syncMode = hasFeature(dc.Protocol(), syncProtocol)
+		hs.compressOffer = hasFeature(dc.Protocol(), compressFeature)
+		hs.heartbeatOffer = hasFeature(dc.Protocol(), heartbeatFeature)
+		if hasFeature(dc.Protocol(), envFeature) {
+			if err := hs.openEnvChannel(); err != nil {
+				log.Println(err)
+			} else {
+				hs.waitEnv = true
+			}
+		}
 		dc.OnOpen(hs.dataChannelOnOpen())
 		dc.OnMessage(hs.dataChannelOnMessage())
 	}
@@ -194,6 +325,10 @@ func (hs *hostSession) createOffer() (err error) {
 		return
 	}
 
+	if hs.signal == nil && hs.trickleICE {
+		hs.trickle(newSignaler(os.Stdin, os.Stdout))
+	}
+
 	// Create channel that is blocked until ICE Gathering is complete
 	gatherComplete := webrtc.GatheringCompletePromise(hs.pc)
 
@@ -203,12 +338,20 @@ func (hs *hostSession) createOffer() (err error) {
 		return
 	}
 
-	// Block until ICE Gathering is complete
-	<-gatherComplete
+	if hs.signal == nil {
+		// Block until ICE Gathering is complete
+		<-gatherComplete
+	}
 
 	hs.offer = sd.SessionDescription{
 		Sdp: hs.pc.LocalDescription().SDP,
 	}
+	hs.offer.SetExpiry(hs.offerTTL)
+	if hs.offerTTL > 0 {
+		// The host goes by its own clock, whatever the client's says.
+		hs.offerExpires = time.Now().Add(hs.offerTTL)
+	}
+	hs.offer.Exec = hs.execMode
 	if hs.oneWay {
 		hs.offer.GenKeys()
 		hs.offer.Encrypt()
@@ -218,6 +361,15 @@ func (hs *hostSession) createOffer() (err error) {
 }
 
 func (hs *hostSession) run() (err error) {
+	if hs.trickleICE && hs.oneWay {
+		return errTrickleOneWay
+	}
+	if hs.lan && hs.oneWay {
+		return errLANOneWay
+	}
+	if hs.trickleICE && hs.execMode {
+		return errTrickleExec
+	}
 	if err = hs.init(); err != nil {
 		return
 	}
@@ -228,43 +380,115 @@ func (hs *hostSession) run() (err error) {
 				"More info here: https://github.com/maxmcd/webtty#one-way-connections\n\n")
 	}
 
+	if hs.lan {
+		if err = hs.listenLAN(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
 	if err = hs.createOffer(); err != nil {
 		return
 	}
 
+	var answer sd.SessionDescription
+	if hs.lan {
+		answer, err = hs.exchangeOverLAN()
+	} else {
+		answer, err = hs.shareOffer()
+	}
+	if err != nil {
+		return
+	}
+	if err = hs.acceptAnswer(answer); err != nil {
+		log.Println(err)
+		return
+	}
+	return hs.setHostRemoteDescriptionAndWait()
+}
+
+// shareOffer prints the offer for the client to paste and waits for the
+// answer on stdin, or on 10kb.site for one-way connections.
+func (hs *hostSession) shareOffer() (answer sd.SessionDescription, err error) {
 	// Output the offer in base64 so we can paste it in browser
 	colorstring.Printf("[bold]Connection ready. Here is your connection data:\n\n")
-	fmt.Printf("%s\n\n", sd.Encode(hs.offer))
-	colorstring.Printf(`[bold]Paste it in the terminal after the webtty command` +
-		"\n[bold]Or in a browser: [reset]https://maxmcd.github.io/webtty/\n\n")
+	encodedOffer := sd.Encode(hs.offer)
+	if hs.signal != nil {
+		if err = hs.signal.sendDescription(hs.offer); err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Println()
+	} else {
+		fmt.Printf("%s\n\n", encodedOffer)
+	}
+	colorstring.Printf("[bold]Paste it in the terminal after the webtty command\n")
+	// The browser client can't trickle candidates, so it can only join
+	// sessions with a complete offer.
+	if hs.signal == nil {
+		colorstring.Printf("[bold]Or in a browser: [reset]" + webClientURL + "\n")
+	}
+	fmt.Println()
+	if hs.qr && hs.signal == nil {
+		colorstring.Printf("[bold]Or scan this code to open it in a browser:\n\n")
+		if err = printQR(os.Stdout, webClientURL+"#"+encodedOffer); err != nil {
+			log.Println(err)
+			return
+		}
+	}
 
 	if hs.oneWay == false {
 		colorstring.Println("[bold]When you have the answer, paste it below and hit enter:")
 		// Wait for the answer to be pasted
-		hs.answer.Sdp, err = hs.mustReadStdin()
+		if hs.signal != nil {
+			answer, err = hs.signal.readDescription()
+		} else {
+			answer.Sdp, err = hs.mustReadStdin()
+		}
 		if err != nil {
 			log.Println(err)
 			return
 		}
 		fmt.Println("Answer received, connecting...")
 	} else {
-		body, err := pollForResponse(hs.offer.TenKbSiteLoc)
+		body, err := pollForResponse(hs.offer.TenKbSiteLoc, hs.offerTTL)
 		if err != nil {
 			log.Println(err)
-			return err
+			return answer, err
 		}
-		hs.answer, err = sd.Decode(body)
+		answer, err = sd.Decode(body)
 		if err != nil {
 			log.Println(err)
-			return err
-		}
-		hs.answer.Key = hs.offer.Key
-		hs.answer.Nonce = hs.offer.Nonce
-		if err = hs.answer.Decrypt(); err != nil {
-			return err
+			return answer, err
 		}
+		answer.Key = hs.offer.Key
+		answer.Nonce = hs.offer.Nonce
+		err = answer.Decrypt()
 	}
-	return hs.setHostRemoteDescriptionAndWait()
+	return
+}
+
+// exchangeOverLAN sends the offer to the client that connected through
+// listenLAN and reads its answer back.
+func (hs *hostSession) exchangeOverLAN() (answer sd.SessionDescription, err error) {
+	colorstring.Printf("[bold]Client connected, exchanging connection data...\n\n")
+	if err = hs.signal.sendDescription(hs.offer); err != nil {
+		log.Println(err)
+		return
+	}
+	if answer, err = hs.signal.readDescription(); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// acceptAnswer records the answer to our offer, unless it arrived after the
+// offer expired. Only one answer is ever read.
+func (hs *hostSession) acceptAnswer(answer sd.SessionDescription) error {
+	if !hs.offerExpires.IsZero() && time.Now().After(hs.offerExpires) {
+		return sd.ErrExpired
+	}
+	hs.answer = answer
+	return nil
 }
 
 func (hs *hostSession) setHostRemoteDescriptionAndWait() (err error) {
@@ -279,6 +503,9 @@ func (hs *hostSession) setHostRemoteDescriptionAndWait() (err error) {
 		log.Println(err)
 		return
 	}
+	if hs.signal != nil {
+		go hs.signal.addRemoteCandidates(hs.pc)
+	}
 
 	// Wait to quit
 	err = <-hs.errChan
@@ -6,13 +6,16 @@ import (
 	"io/ioutil"
 	"os/exec"
 	"testing"
+	"time"
 
 	"github.com/kr/pty"
+	"github.com/maxmcd/webtty/pkg/sd"
 	"github.com/pion/webrtc/v3"
 )
 
 func TestHosttDataChannelOnMessage(t *testing.T) {
-	hs := hostSession{ptmxReady: true}
+	hs := hostSession{}
+	hs.started.Store(&runningCommand{})
 	hs.errChan = make(chan error, 1)
 	onMessage := hs.dataChannelOnMessage()
 	quitPayload := webrtc.DataChannelMessage{IsString: true, Data: []byte("quit")}
@@ -40,8 +43,9 @@ func TestHosttDataChannelOnMessage(t *testing.T) {
 
 }
 
-func makeShPty(t *testing.T) (func(p webrtc.DataChannelMessage), hostSession) {
-	hs := hostSession{ptmxReady: true}
+func makeShPty(t *testing.T) (func(p webrtc.DataChannelMessage), *hostSession) {
+	hs := &hostSession{}
+	hs.started.Store(&runningCommand{})
 	hs.errChan = make(chan error, 1)
 	onMessage := hs.dataChannelOnMessage()
 	c := exec.Command("sh")
@@ -87,3 +91,24 @@ func TestClientSetSizeOnMessage(t *testing.T) {
 
 	}
 }
+
+func TestAcceptAnswer(t *testing.T) {
+	hs := hostSession{offerExpires: time.Now().Add(time.Minute)}
+	// The host ignores the time in the offer, a client could have changed it.
+	hs.offer.Created = time.Now().Add(-time.Hour).Unix()
+	hs.offer.TTL = 60
+	if err := hs.acceptAnswer(sd.SessionDescription{Sdp: "answer"}); err != nil {
+		t.Error(err)
+	}
+	if hs.answer.Sdp != "answer" {
+		t.Error("answer wasn't recorded", hs.answer.Sdp)
+	}
+
+	hs = hostSession{offerExpires: time.Now().Add(-time.Second)}
+	if err := hs.acceptAnswer(sd.SessionDescription{}); err != sd.ErrExpired {
+		t.Error("expired offer should be rejected", err)
+	}
+	if err := (&hostSession{}).acceptAnswer(sd.SessionDescription{}); err != nil {
+		t.Error("offers without a TTL never expire", err)
+	}
+}
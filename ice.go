@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	errICEFailed = errors.New("no network path to the peer worked (ICE failed). " +
+		"If both sides are behind strict NATs or firewalls, " +
+		"add a TURN server with -ice turn:user:pass@host:port")
+	errNoRelay = errors.New("-relay-only needs at least one turn: or turns: server")
+)
+
+// iceServerFlags collects repeated -ice flags. Each value is a stun:,
+// turn: or turns: URL, TURN URLs can carry credentials as
+// turn:username:credential@host:port.
+type iceServerFlags []webrtc.ICEServer
+
+func (f *iceServerFlags) String() string {
+	var urls []string
+	for _, server := range *f {
+		urls = append(urls, server.URLs...)
+	}
+	return strings.Join(urls, ",")
+}
+
+func (f *iceServerFlags) Set(value string) error {
+	server, err := parseICEServer(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, server)
+	return nil
+}
+
+func parseICEServer(value string) (server webrtc.ICEServer, err error) {
+	i := strings.IndexByte(value, ':')
+	if i < 0 {
+		return server, fmt.Errorf("ice server %q has no scheme", value)
+	}
+	scheme, rest := value[:i], value[i+1:]
+	switch scheme {
+	case "stun", "stuns", "turn", "turns":
+	default:
+		return server, fmt.Errorf("ice server %q must be a stun:, turn: or turns: url", value)
+	}
+	if at := strings.LastIndexByte(rest, '@'); at >= 0 {
+		userinfo := rest[:at]
+		rest = rest[at+1:]
+		user, credential := userinfo, ""
+		if colon := strings.IndexByte(userinfo, ':'); colon >= 0 {
+			user, credential = userinfo[:colon], userinfo[colon+1:]
+		}
+		if server.Username, err = url.PathUnescape(user); err != nil {
+			return
+		}
+		var pass string
+		if pass, err = url.PathUnescape(credential); err != nil {
+			return
+		}
+		server.Credential = pass
+		server.CredentialType = webrtc.ICECredentialTypePassword
+	}
+	server.URLs = []string{scheme + ":" + rest}
+	return server, nil
+}
+
+// turnRESTCredentials makes time limited credentials from a secret shared
+// with the TURN server, as in the "TURN REST API" draft that coturn and
+// pion/turn implement.
+func turnRESTCredentials(secret, user string, ttl time.Duration) (username, credential string) {
+	username = fmt.Sprintf("%d:%s", time.Now().Add(ttl).Unix(), user)
+	return username, turnRESTPassword(secret, username)
+}
+
+// turnRESTPassword derives the credential for a REST API username.
+func turnRESTPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// applyTURNSecret fills in REST credentials for TURN servers that were
+// given without a username.
+func applyTURNSecret(servers []webrtc.ICEServer, secret string, ttl time.Duration) {
+	if secret == "" {
+		return
+	}
+	for i, server := range servers {
+		if server.Username != "" || !hasTURNServer([]webrtc.ICEServer{server}) {
+			continue
+		}
+		servers[i].Username, servers[i].Credential = turnRESTCredentials(secret, "webtty", ttl)
+		servers[i].CredentialType = webrtc.ICECredentialTypePassword
+	}
+}
+
+func hasTURNServer(servers []webrtc.ICEServer) bool {
+	for _, server := range servers {
+		for _, u := range server.URLs {
+			if strings.HasPrefix(u, "turn") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseICEServer(t *testing.T) {
+	var servers iceServerFlags
+	for _, value := range []string{
+		"stun:stun.example.com:3478",
+		"turn:alice:s%40cret@turn.example.com:3478?transport=tcp",
+		"turns:turn.example.com:5349",
+	} {
+		if err := servers.Set(value); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(servers) != 3 {
+		t.Fatal("wrong number of servers", len(servers))
+	}
+	if servers[0].Username != "" || servers[0].URLs[0] != "stun:stun.example.com:3478" {
+		t.Error(servers[0])
+	}
+	if servers[1].URLs[0] != "turn:turn.example.com:3478?transport=tcp" ||
+		servers[1].Username != "alice" || servers[1].Credential != "s@cret" {
+		t.Error(servers[1])
+	}
+	if err := servers.Set("http://example.com"); err == nil {
+		t.Error("should reject non ice urls")
+	}
+}
+
+func TestApplyTURNSecret(t *testing.T) {
+	servers := []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.example.com"}},
+		{URLs: []string{"turn:turn.example.com"}},
+		{URLs: []string{"turn:other.example.com"}, Username: "bob", Credential: "pw"},
+	}
+	applyTURNSecret(servers, "secret", time.Hour)
+	if servers[0].Username != "" || servers[2].Username != "bob" {
+		t.Error("only turn servers without credentials should change")
+	}
+	parts := strings.SplitN(servers[1].Username, ":", 2)
+	if len(parts) != 2 || parts[1] != "webtty" {
+		t.Fatal("wrong username", servers[1].Username)
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(servers[1].Username))
+	if servers[1].Credential != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Error("wrong credential")
+	}
+}
+
+func TestRelayOnlyNeedsTURN(t *testing.T) {
+	s := session{relayOnly: true}
+	if err := s.createPeerConnection(); err != errNoRelay {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/mitchellh/colorstring"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	lanService = "_webtty._tcp"
+	lanDomain  = "local."
+)
+
+var (
+	errNoLANHosts      = errors.New("no webtty hosts found on the local network")
+	errLANOneWay       = errors.New("local network sessions can't be used with one-way connections")
+	errBadSelector     = errors.New("not one of the listed hosts")
+	errPairingRejected = errors.New("the host rejected the pairing code")
+	errBadChallenge    = errors.New("the host didn't send a pairing challenge")
+)
+
+var (
+	// lanBrowseTimeout is how long -discover listens for hosts.
+	lanBrowseTimeout = 3 * time.Second
+	// pairingTimeout bounds the pairing handshake, so a silent peer can't
+	// hold up the ones after it.
+	pairingTimeout = 10 * time.Second
+	// pairingFailureDelay slows down guessing the code, one peer at a time.
+	pairingFailureDelay = time.Second
+)
+
+// newPairingCode returns a random six digit code the host shows and the
+// client types in to derive their shared key.
+func newPairingCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// pairingKey stretches a pairing code into a hex AES key, salted with the
+// advertised instance name so the same code differs between hosts.
+func pairingKey(code, instance string) string {
+	key := pbkdf2.Key([]byte(code), []byte("webtty "+instance), 100000, 32, sha256.New)
+	return hex.EncodeToString(key)
+}
+
+// pairingProof is the client's answer to a pairing challenge. Only a peer
+// that knows the code can make it, and a peer that connects learns nothing
+// it could test guesses of the code against.
+func pairingProof(key string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("webtty pairing "))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// acceptPaired accepts connections until a peer proves it knows the
+// pairing key. Nothing encrypted is sent before that, and peers that fail,
+// like port scanners or a mistyped code, are dropped without ending the
+// session.
+func acceptPaired(ln net.Listener, key string) (net.Conn, error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("LAN client connected from %s\n", conn.RemoteAddr())
+		if err = checkPairing(conn, key); err == nil {
+			return conn, nil
+		}
+		log.Printf("Pairing with %s failed: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		time.Sleep(pairingFailureDelay)
+	}
+}
+
+// checkPairing challenges a peer to prove it knows the key, and tells it
+// whether it did.
+func checkPairing(conn net.Conn, key string) error {
+	conn.SetDeadline(time.Now().Add(pairingTimeout))
+	defer conn.SetDeadline(time.Time{})
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	sig := newSignaler(conn, conn)
+	if err := sig.writeLine("challenge " + hex.EncodeToString(challenge)); err != nil {
+		return err
+	}
+	line, err := sig.readLine()
+	if err != nil {
+		return err
+	}
+	proof, err := hex.DecodeString(strings.TrimPrefix(line, "proof "))
+	if err != nil || !hmac.Equal(proof, pairingProof(key, challenge)) {
+		sig.writeLine("rejected")
+		return errWrongKey
+	}
+	return sig.writeLine("paired")
+}
+
+// pair answers the host's pairing challenge.
+func pair(conn net.Conn, key string) error {
+	conn.SetDeadline(time.Now().Add(pairingTimeout))
+	defer conn.SetDeadline(time.Time{})
+	sig := newSignaler(conn, conn)
+	line, err := sig.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "challenge ") {
+		return errBadChallenge
+	}
+	challenge, err := hex.DecodeString(strings.TrimPrefix(line, "challenge "))
+	if err != nil {
+		return errBadChallenge
+	}
+	if err = sig.writeLine("proof " + hex.EncodeToString(pairingProof(key, challenge))); err != nil {
+		return err
+	}
+	if line, err = sig.readLine(); err != nil || line != "paired" {
+		return errPairingRejected
+	}
+	return nil
+}
+
+func lanInstanceName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "webtty"
+	}
+	// Dots would be escaped in the service instance name
+	hostname = strings.Replace(hostname, ".", "-", -1)
+	return hostname + "-" + randSeq(4)
+}
+
+// listenLAN advertises the session over mDNS and waits for a client that
+// knows the pairing code to connect. The connection then carries the offer,
+// answer and trickled candidates, with descriptions encrypted by the
+// pairing code.
+func (hs *hostSession) listenLAN() (err error) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return
+	}
+	defer ln.Close()
+
+	instance := lanInstanceName()
+	code, err := newPairingCode()
+	if err != nil {
+		return
+	}
+	server, err := zeroconf.Register(instance, lanService, lanDomain,
+		ln.Addr().(*net.TCPAddr).Port, []string{"v=1"}, nil)
+	if err != nil {
+		return
+	}
+	// Sessions are single use, stop advertising once a client shows up
+	defer server.Shutdown()
+
+	colorstring.Printf("[bold]Advertising on the local network as [reset]%s\n", instance)
+	colorstring.Printf("[bold]Run [reset]webtty -discover[bold] on the other machine and enter the pairing code: [reset]%s\n\n", code)
+
+	key := pairingKey(code, instance)
+	conn, err := acceptPaired(ln, key)
+	if err != nil {
+		return
+	}
+	sig := newSignaler(conn, conn)
+	sig.key = key
+	hs.trickle(sig)
+	return
+}
+
+// discoverLANHost lists the hosts advertising on the local network, asks
+// which one to join and for its pairing code, and connects to it.
+func discoverLANHost() (sig *signaler, err error) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	var hosts []*zeroconf.ServiceEntry
+	done := make(chan struct{})
+	go func() {
+		for entry := range entries {
+			if len(entry.AddrIPv4)+len(entry.AddrIPv6) > 0 {
+				hosts = append(hosts, entry)
+			}
+		}
+		close(done)
+	}()
+
+	colorstring.Printf("[bold]Looking for webtty hosts on the local network...\n\n")
+	ctx, cancel := context.WithTimeout(context.Background(), lanBrowseTimeout)
+	defer cancel()
+	if err = resolver.Browse(ctx, lanService, lanDomain, entries); err != nil {
+		return
+	}
+	<-ctx.Done()
+	<-done
+	if len(hosts) == 0 {
+		return nil, errNoLANHosts
+	}
+
+	for i, host := range hosts {
+		fmt.Printf("  %d) %s (%s)\n", i+1, host.Instance, lanAddr(host))
+	}
+	choice := 1
+	if len(hosts) > 1 {
+		fmt.Printf("\nSelect a host: ")
+		var input string
+		fmt.Scanln(&input)
+		if choice, err = strconv.Atoi(input); err != nil || choice < 1 || choice > len(hosts) {
+			return nil, errBadSelector
+		}
+	}
+	host := hosts[choice-1]
+
+	fmt.Printf("\nPairing code for %s: ", host.Instance)
+	var code string
+	fmt.Scanln(&code)
+
+	conn, err := net.DialTimeout("tcp", lanAddr(host), 10*time.Second)
+	if err != nil {
+		return
+	}
+	key := pairingKey(strings.TrimSpace(code), host.Instance)
+	if err = pair(conn, key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sig = newSignaler(conn, conn)
+	sig.key = key
+	return sig, nil
+}
+
+func lanAddr(host *zeroconf.ServiceEntry) string {
+	var ip net.IP
+	if len(host.AddrIPv4) > 0 {
+		ip = host.AddrIPv4[0]
+	} else {
+		ip = host.AddrIPv6[0]
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(host.Port))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/webtty/pkg/sd"
+)
+
+func TestPairingCode(t *testing.T) {
+	code, err := newPairingCode()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(code) != 6 {
+		t.Error("code should be six digits", code)
+	}
+	if pairingKey(code, "a") != pairingKey(code, "a") {
+		t.Error("keys should be deterministic")
+	}
+	if pairingKey(code, "a") == pairingKey(code, "b") {
+		t.Error("keys should be salted with the instance name")
+	}
+}
+
+func TestSignalerEncryptsDescriptions(t *testing.T) {
+	key := pairingKey("123456", "host")
+	var out bytes.Buffer
+	sig := newSignaler(nil, &out)
+	sig.key = key
+	if err := sig.sendDescription(sd.SessionDescription{Sdp: "plain sdp"}); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := sd.Decode(string(bytes.TrimSpace(out.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Sdp == "plain sdp" || sent.Key != "" {
+		t.Error("description should be encrypted without its key")
+	}
+
+	reader := newSignaler(bytes.NewReader(out.Bytes()), nil)
+	reader.key = key
+	desc, err := reader.readDescription()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Sdp != "plain sdp" || desc.Key != "" || desc.Nonce != "" {
+		t.Error("wrong description", desc)
+	}
+
+	reader = newSignaler(bytes.NewReader(out.Bytes()), nil)
+	reader.key = pairingKey("654321", "host")
+	if _, err = reader.readDescription(); err != errWrongKey {
+		t.Error("wrong codes should fail to decrypt", err)
+	}
+}
+
+func TestAcceptPaired(t *testing.T) {
+	defer func(d time.Duration) { pairingFailureDelay = d }(pairingFailureDelay)
+	pairingFailureDelay = 0
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	key := pairingKey("123456", "host")
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := acceptPaired(ln, key)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	// A port scan, then a wrong code.
+	scan, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan.Close()
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if err = pair(bad, pairingKey("654321", "host")); err != errPairingRejected {
+		t.Error("wrong codes should be rejected", err)
+	}
+
+	good, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	if err = pair(good, key); err != nil {
+		t.Fatal("the right code should pair after failed peers", err)
+	}
+	conn := <-accepted
+	defer conn.Close()
+	if _, err = conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := newSignaler(good, nil).readLine(); err != nil || line != "hello" {
+		t.Error("the paired connection should carry signaling", line, err)
+	}
+}
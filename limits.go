@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// killGrace is how long the command gets to exit after SIGHUP before the
+// whole process group is killed.
+const killGrace = 2 * time.Second
+
+var (
+	errIdleTimeout = errors.New("session ended because the client was idle")
+	errMaxDuration = errors.New("session ended because it reached its maximum duration")
+)
+
+// touch records input from the client.
+func (hs *hostSession) touch() {
+	atomic.StoreInt64(&hs.lastInput, time.Now().UnixNano())
+}
+
+// warnBefore is how long before a limit the client is warned.
+func warnBefore(limit time.Duration) time.Duration {
+	if limit/5 < time.Minute {
+		return limit / 5
+	}
+	return time.Minute
+}
+
+// enforceLimits ends the session once the client has sent no input for
+// hs.idleTimeout, or the session has lasted hs.maxDuration. The client is
+// warned before either happens.
+func (hs *hostSession) enforceLimits(process *os.Process) {
+	if hs.idleTimeout <= 0 && hs.maxDuration <= 0 {
+		return
+	}
+	interval := time.Second
+	for _, limit := range []time.Duration{hs.idleTimeout, hs.maxDuration} {
+		if limit > 0 && limit/10 < interval {
+			interval = limit / 10
+		}
+	}
+
+	start := time.Now()
+	hs.touch()
+	warnedIdle, warnedMax := false, false
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if hs.maxDuration > 0 {
+			left := hs.maxDuration - now.Sub(start)
+			if left <= 0 {
+				hs.endSession(process, errMaxDuration)
+				return
+			}
+			if !warnedMax && left <= warnBefore(hs.maxDuration) {
+				hs.notify(fmt.Sprintf("This session will end in %s, its maximum duration is %s.",
+					left.Round(time.Second), hs.maxDuration))
+				warnedMax = true
+			}
+		}
+		if hs.idleTimeout > 0 {
+			left := hs.idleTimeout - now.Sub(time.Unix(0, atomic.LoadInt64(&hs.lastInput)))
+			if left <= 0 {
+				hs.endSession(process, errIdleTimeout)
+				return
+			}
+			if left > warnBefore(hs.idleTimeout) {
+				warnedIdle = false
+			} else if !warnedIdle {
+				hs.notify(fmt.Sprintf("This session has been idle and will end in %s unless you type something.",
+					left.Round(time.Second)))
+				warnedIdle = true
+			}
+		}
+	}
+}
+
+// notify writes a message to the client's terminal.
+func (hs *hostSession) notify(msg string) {
+	log.Println(msg)
+	if hs.dc == nil {
+		return
+	}
+	if hs.screen != nil {
+		// Raw output would be drawn over the synced screen.
+		notice, _ := json.Marshal([]string{"notice", "[webtty] " + msg})
+		if err := hs.dc.SendText(string(notice)); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	send := hs.dc.Send
+	if hs.flow != nil {
+		send = hs.flow.write
+	}
+	if err := send([]byte("\r\n\x1b[1m[webtty] " + msg + "\x1b[0m\r\n")); err != nil {
+		log.Println(err)
+	}
+}
+
+// endSession kills the command's process group and ends the session with
+// reason.
+func (hs *hostSession) endSession(process *os.Process, reason error) {
+	hs.notify(reason.Error() + ".")
+	hs.endReason.Store(reason)
+	killProcessGroup(process)
+	select {
+	case hs.errChan <- reason:
+	default:
+	}
+}
+
+// killProcessGroup hangs up the process group started by pty.Start, which
+// makes the command a session and group leader, and kills whatever is left
+// after killGrace.
+func killProcessGroup(process *os.Process) {
+	pgid := -process.Pid
+	if err := syscall.Kill(pgid, syscall.SIGHUP); err != nil {
+		log.Println(err)
+		return
+	}
+	deadline := time.Now().Add(killGrace)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pgid, 0) == syscall.ESRCH {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := syscall.Kill(pgid, syscall.SIGKILL); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+)
+
+// startLimitedSession starts a shell that ignores hangups, so the process
+// group has to be killed.
+func startLimitedSession(t *testing.T, hs *hostSession) *exec.Cmd {
+	hs.errChan = make(chan error, 1)
+	cmd := exec.Command("sh", "-c", "trap '' HUP; sleep 30 & wait")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.ptmx = ptmx
+	go hs.enforceLimits(cmd.Process)
+	return cmd
+}
+
+func waitForEnd(t *testing.T, hs *hostSession, cmd *exec.Cmd, want error) {
+	select {
+	case err := <-hs.errChan:
+		if err != want {
+			t.Errorf("got %v, want %v", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session should have ended")
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Error("command should have been killed")
+	}
+	hs.ptmx.Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	hs := &hostSession{idleTimeout: 500 * time.Millisecond}
+	cmd := startLimitedSession(t, hs)
+	start := time.Now()
+	waitForEnd(t, hs, cmd, errIdleTimeout)
+	if time.Since(start) < 500*time.Millisecond {
+		t.Error("ended too soon")
+	}
+}
+
+func TestIdleTimeoutResetByInput(t *testing.T) {
+	hs := &hostSession{idleTimeout: 500 * time.Millisecond, maxDuration: 1500 * time.Millisecond}
+	cmd := startLimitedSession(t, hs)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Millisecond):
+				hs.touch()
+			}
+		}
+	}()
+	start := time.Now()
+	waitForEnd(t, hs, cmd, errMaxDuration)
+	if time.Since(start) < 1500*time.Millisecond {
+		t.Error("input should keep the session alive until the maximum duration")
+	}
+}
+
+func TestWarnBefore(t *testing.T) {
+	if warnBefore(time.Hour) != time.Minute || warnBefore(time.Minute) != 12*time.Second {
+		t.Error("clients are warned a minute before, or a fifth of the limit")
+	}
+}
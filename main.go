@@ -1,61 +1,315 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var (
+	defaultCmd = []string{"bash", "-l"}
+	errNoOffer = errors.New("join needs an offer, or -discover to find a host on the local network")
 )
 
 func main() {
-	oneWay := flag.Bool("o", false, "One-way connection with no response needed.")
-	verbose := flag.Bool("v", false, "Verbose logging")
-	nonInteractive := flag.Bool("non-interactive", false, "Set host to non-interactive")
-	ni := flag.Bool("ni", false, "Set host to non-interactive")
-	_ = flag.Bool("cmd", false, "The command to run. Default is \"bash -l\"\n"+
-		"Because this flag consumes the remainder of the command line,\n"+
-		"all other args (if present) must appear before this flag.\n"+
-		"eg: webtty -o -v -ni -cmd docker run -it --rm alpine:latest sh")
-	stunServer := flag.String("s", "stun:stun.l.google.com:19302", "The stun server to use")
-
-	cmd := []string{"bash", "-l"}
-	for i, arg := range os.Args {
-		if arg == "-cmd" {
-			cmd = os.Args[i+1:]
-			os.Args = os.Args[:i]
-		}
-	}
-	flag.Parse()
-	if *verbose {
+	if err := runCommand(os.Args[1:]); err != nil {
+		if status, ok := err.(exitStatus); ok {
+			os.Exit(int(status))
+		}
+		// On stderr, so it never ends up in data piped out of -exec sessions.
+		fmt.Fprintf(os.Stderr, "Quitting with an unexpected error: \"%s\"\n", err)
+		os.Exit(1)
+	}
+}
+
+// sessionOptions holds the flags shared by the host and join commands.
+type sessionOptions struct {
+	verbose     bool
+	stunServer  string
+	iceFlags    iceServerFlags
+	iceSecret   string
+	relayOnly   bool
+	peerTimeout time.Duration
+	compress    bool
+	readSize    int
+	batchWindow time.Duration
+	qr          bool
+	configPath  string
+	profile     string
+	network     networkOptions
+
+	oneWay         bool
+	nonInteractive bool
+	trickle        bool
+	lan            bool
+	offerTTL       time.Duration
+	idleTimeout    time.Duration
+	maxDuration    time.Duration
+	slowClient     string
+	exec           bool
+	dir            string
+	env            envFlags
+	acceptEnv      string
+
+	discover   bool
+	stats      bool
+	escapeChar string
+	predict    bool
+	sync       bool
+	sendEnv    string
+}
+
+func (o *sessionOptions) commonFlags(flags *flag.FlagSet) {
+	o.baseFlags(flags)
+	o.connectivityFlags(flags)
+	flags.BoolVar(&o.relayOnly, "relay-only", false, "Only connect through TURN relays")
+	flags.BoolVar(&o.qr, "qr", false, "Also print the offer or answer as a QR code")
+	flags.DurationVar(&o.peerTimeout, "peer-timeout", 30*time.Second, "Disconnect when nothing is heard from the other side for this long. 0 never times out")
+	flags.BoolVar(&o.compress, "compress", true, "Compress terminal output and input when the other side supports it")
+	flags.IntVar(&o.readSize, "read-size", defaultReadSize, "The most terminal output or input sent in one message")
+	flags.DurationVar(&o.batchWindow, "batch-window", defaultBatchWindow, "How long to collect output during a burst before sending it.\n"+
+		"Typing after a pause is always sent at once. 0 sends every read")
+}
+
+func (o *sessionOptions) baseFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.verbose, "v", false, "Verbose logging")
+	flags.StringVar(&o.configPath, "config", defaultConfigPath(), "The config file to read")
+	flags.StringVar(&o.profile, "profile", "", "Use a named profile from the config file")
+}
+
+// connectivityFlags are the STUN/TURN servers and network options used to
+// gather candidates.
+func (o *sessionOptions) connectivityFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.stunServer, "s", "stun:stun.l.google.com:19302", "The stun server to use")
+	flags.Var(&o.iceFlags, "ice", "An extra stun:, turn: or turns: server, may be repeated.\n"+
+		"TURN credentials can be given as turn:username:credential@host:port")
+	flags.StringVar(&o.iceSecret, "ice-secret", "", "Shared secret for time-limited TURN credentials (TURN REST API)")
+	o.network.flags(flags)
+}
+
+func (o *sessionOptions) hostFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.oneWay, "o", false, "One-way connection with no response needed.")
+	flags.BoolVar(&o.nonInteractive, "non-interactive", false, "Set host to non-interactive")
+	flags.BoolVar(&o.nonInteractive, "ni", false, "Set host to non-interactive")
+	flags.BoolVar(&o.trickle, "trickle", false, "Trickle ICE candidates over stdout/stdin instead of waiting for gathering.\n"+
+		"Only useful when stdin and stdout are connected to the other peer")
+	flags.BoolVar(&o.lan, "lan", false, "Advertise the session on the local network over mDNS")
+	flags.DurationVar(&o.offerTTL, "ttl", 10*time.Minute, "How long an offer stays valid. 0 never expires")
+	flags.DurationVar(&o.idleTimeout, "idle-timeout", 0, "End the session when the client sends no input for this long")
+	flags.DurationVar(&o.maxDuration, "max-duration", 0, "End the session after this long")
+	flags.StringVar(&o.slowClient, "slow-client", "pause", "When the client falls behind, \"pause\" the command until it catches up,\n"+
+		"or \"drop\" output and send the latest when it does")
+	flags.BoolVar(&o.exec, "exec", false, "Run the command with pipes instead of a terminal, for scripts and piping data.\n"+
+		"The client's stdin and stdout are the command's, and it exits with the command's status")
+	flags.StringVar(&o.dir, "dir", "", "The directory to run the command in")
+	flags.Var(&o.env, "env", "Set a KEY=VALUE variable for the command, may be repeated")
+	flags.StringVar(&o.acceptEnv, "accept-env", "", "Also take these variables from the client, eg: EDITOR,GIT_*.\n"+
+		"TERM, COLORTERM, LANG and LC_* are always taken")
+	o.network.hostFlags(flags)
+}
+
+func (o *sessionOptions) joinFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.discover, "discover", false, "Join a session advertised on the local network")
+	flags.BoolVar(&o.stats, "stats", false, "Show connection stats on the bottom line of the terminal.\n"+
+		"Type ~s at the start of a line to show them once")
+	flags.StringVar(&o.escapeChar, "e", "~", "The escape character, typed at the start of a line before a command.\n"+
+		"~? lists the commands. \"none\" disables escapes")
+	flags.BoolVar(&o.sync, "sync", false, "Sync the screen instead of streaming output, so lost packets can't corrupt it")
+	flags.BoolVar(&o.predict, "predict", false, "Echo typing locally before the host does, for slow connections")
+	flags.StringVar(&o.sendEnv, "send-env", "", "Also send these variables to the host if it accepts them, eg: EDITOR,GIT_*.\n"+
+		"TERM, COLORTERM, LANG and LC_* are always sent")
+}
+
+// configure applies the config file to flags that weren't given on the
+// command line and sets up logging. It returns the configured command.
+func (o *sessionOptions) configure(flags *flag.FlagSet) ([]string, error) {
+	settings, err := loadConfig(o.configPath, o.profile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load the config file: %s", err)
+	}
+	cmd, err := applyConfig(flags, settings)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load the config file: %s", err)
+	}
+	if o.verbose {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	} else {
 		log.SetFlags(0)
 		log.SetOutput(ioutil.Discard)
 	}
-	args := flag.Args()
-	var offerString string
-	if len(args) > 0 {
-		offerString = args[len(args)-1]
+	return cmd, nil
+}
+
+func (o *sessionOptions) iceServers() []webrtc.ICEServer {
+	var iceServers []webrtc.ICEServer
+	if o.stunServer != "" {
+		iceServers = append(iceServers, webrtc.ICEServer{URLs: []string{o.stunServer}})
+	}
+	iceServers = append(iceServers, o.iceFlags...)
+	applyTURNSecret(iceServers, o.iceSecret, 24*time.Hour)
+	return iceServers
+}
+
+func (o *sessionOptions) host(cmd []string) error {
+	dropOutput, err := parseSlowClient(o.slowClient)
+	if err != nil {
+		return err
+	}
+	if err = checkReadSize(o.readSize); err != nil {
+		return err
+	}
+	if o.dir != "" {
+		if info, err := os.Stat(o.dir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("-dir %s isn't a directory", o.dir)
+		}
+	}
+	hc := hostSession{
+		oneWay:         o.oneWay,
+		cmd:            cmd,
+		nonInteractive: o.nonInteractive,
+		offerTTL:       o.offerTTL,
+		qr:             o.qr,
+		trickleICE:     o.trickle,
+		lan:            o.lan,
+		logStats:       o.verbose,
+		idleTimeout:    o.idleTimeout,
+		maxDuration:    o.maxDuration,
+		dropOutput:     dropOutput,
+		execMode:       o.exec,
+		dir:            o.dir,
+		env:            o.env,
+		acceptEnv:      envPatterns(defaultEnv, o.acceptEnv),
+		clientEnv:      make(chan []string, 1),
+	}
+	hc.iceServers = o.iceServers()
+	hc.relayOnly = o.relayOnly
+	hc.peerTimeout = o.peerTimeout
+	hc.compress = o.compress
+	hc.readSize = o.readSize
+	hc.batchWindow = o.batchWindow
+	hc.network = o.network
+	return hc.run()
+}
+
+func (o *sessionOptions) join(offerString string) error {
+	escapeChar, err := parseEscapeChar(o.escapeChar)
+	if err != nil {
+		return err
+	}
+	if err = checkReadSize(o.readSize); err != nil {
+		return err
+	}
+	cc := clientSession{
+		offerString: offerString,
+		qr:          o.qr,
+		discover:    o.discover,
+		stats:       o.stats,
+		escapeChar:  escapeChar,
+		sync:        o.sync,
+		sendEnvs:    envPatterns(defaultEnv, o.sendEnv),
 	}
+	if o.predict {
+		cc.predict = &predictor{}
+	}
+	cc.iceServers = o.iceServers()
+	cc.relayOnly = o.relayOnly
+	cc.peerTimeout = o.peerTimeout
+	cc.compress = o.compress
+	cc.readSize = o.readSize
+	cc.batchWindow = o.batchWindow
+	cc.network = o.network
+	return cc.run()
+}
 
-	var err error
-	if len(offerString) == 0 {
-		hc := hostSession{
-			oneWay:         *oneWay,
-			cmd:            cmd,
-			nonInteractive: *nonInteractive || *ni,
+func hostCommand(flags *flag.FlagSet) func() error {
+	var o sessionOptions
+	o.commonFlags(flags)
+	o.hostFlags(flags)
+	return func() error {
+		configCmd, err := o.configure(flags)
+		if err != nil {
+			return err
 		}
-		hc.stunServers = []string{*stunServer}
-		err = hc.run()
-	} else {
-		cc := clientSession{
-			offerString: offerString,
+		cmd := flags.Args()
+		if len(cmd) == 0 {
+			cmd = configCmd
+		}
+		if len(cmd) == 0 {
+			cmd = defaultCmd
+		}
+		return o.host(cmd)
+	}
+}
+
+func joinCommand(flags *flag.FlagSet) func() error {
+	var o sessionOptions
+	o.commonFlags(flags)
+	o.joinFlags(flags)
+	return func() error {
+		if _, err := o.configure(flags); err != nil {
+			return err
+		}
+		if flags.NArg() > 1 {
+			return fmt.Errorf("join takes a single offer, got %d arguments", flags.NArg())
+		}
+		if flags.NArg() == 0 && !o.discover {
+			return errNoOffer
 		}
-		cc.stunServers = []string{*stunServer}
-		err = cc.run()
+		return o.join(flags.Arg(0))
 	}
+}
+
+// runLegacy keeps the original invocation working: "webtty [flags]" hosts,
+// "webtty [flags] OFFER" joins, and everything after -cmd is the command.
+func runLegacy(args []string) error {
+	args, cmd := splitCmdFlag(args)
+
+	var o sessionOptions
+	flags := flag.NewFlagSet("webtty", flag.ExitOnError)
+	flags.Usage = func() { printUsage(flags.Output()) }
+	o.commonFlags(flags)
+	o.hostFlags(flags)
+	o.joinFlags(flags)
+	flags.Parse(args)
+
+	configCmd, err := o.configure(flags)
 	if err != nil {
-		fmt.Printf("Quitting with an unexpected error: \"%s\"\n", err)
+		return err
+	}
+	if flags.NArg() > 0 || o.discover {
+		var offerString string
+		if flags.NArg() > 0 {
+			offerString = flags.Arg(flags.NArg() - 1)
+		}
+		return o.join(offerString)
+	}
+	if cmd == nil {
+		cmd = configCmd
+	}
+	if len(cmd) == 0 {
+		cmd = defaultCmd
+	}
+	return o.host(cmd)
+}
+
+// splitCmdFlag splits the arguments at -cmd, which consumes the remainder
+// of the command line.
+func splitCmdFlag(args []string) (flags, cmd []string) {
+	for i, arg := range args {
+		if arg == "-cmd" || arg == "--cmd" {
+			return args[:i], append([]string{}, args[i+1:]...)
+		}
 	}
+	return args, nil
 }
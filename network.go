@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// networkOptions control which local addresses and ports ICE gathers
+// candidates on, for hosts where only some of them are reachable.
+type networkOptions struct {
+	portRange  string
+	udpPort    int
+	tcpPort    int
+	interfaces string
+	ipNets     string
+	natIPs     string
+	ipVersion  string
+	mdns       string
+}
+
+func (n *networkOptions) flags(flags *flag.FlagSet) {
+	flags.StringVar(&n.portRange, "ports", "", "Only use UDP ports in this range, eg: 50000-50100")
+	flags.IntVar(&n.udpPort, "udp-port", 0, "Send all ICE traffic through this single UDP port")
+	flags.StringVar(&n.interfaces, "interfaces", "", "Only gather candidates on these network interfaces, eg: eth0,wg0")
+	flags.StringVar(&n.ipNets, "ips", "", "Only gather candidates on interfaces with an address in these networks, eg: 10.0.0.0/8")
+	flags.StringVar(&n.natIPs, "nat-ip", "", "Advertise these public IPs instead of the local ones (1:1 NAT), eg: 203.0.113.4")
+	flags.StringVar(&n.ipVersion, "network", "", "Only use \"ipv4\" or \"ipv6\"")
+	flags.StringVar(&n.mdns, "mdns", "", "mDNS candidates: \"disabled\", \"query\" to resolve remote ones (default)\n"+
+		"or \"gather\" to also hide local addresses behind .local names")
+}
+
+// hostFlags are the options that only make sense for the side that waits
+// for connections.
+func (n *networkOptions) hostFlags(flags *flag.FlagSet) {
+	flags.IntVar(&n.tcpPort, "tcp-port", 0, "Also accept ICE-TCP on this port, for clients on networks that block UDP")
+}
+
+// settingEngine builds the pion SettingEngine for the options. Listeners
+// opened for a single UDP or ICE-TCP port are returned so the session can
+// close them.
+func (n networkOptions) settingEngine() (se webrtc.SettingEngine, closers []io.Closer, err error) {
+	if n.portRange != "" {
+		var min, max uint64
+		parts := strings.SplitN(n.portRange, "-", 2)
+		if len(parts) != 2 {
+			return se, nil, fmt.Errorf("port range %q should be written as min-max", n.portRange)
+		}
+		if min, err = strconv.ParseUint(parts[0], 10, 16); err != nil {
+			return se, nil, fmt.Errorf("invalid port range %q", n.portRange)
+		}
+		if max, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+			return se, nil, fmt.Errorf("invalid port range %q", n.portRange)
+		}
+		if err = se.SetEphemeralUDPPortRange(uint16(min), uint16(max)); err != nil {
+			return se, nil, fmt.Errorf("invalid port range %q: %s", n.portRange, err)
+		}
+	}
+
+	filter, err := n.interfaceFilter()
+	if err != nil {
+		return se, nil, err
+	}
+	if filter != nil {
+		se.SetInterfaceFilter(filter)
+	}
+
+	if n.natIPs != "" {
+		se.SetNAT1To1IPs(splitList(n.natIPs), webrtc.ICECandidateTypeHost)
+	}
+
+	var networkTypes []webrtc.NetworkType
+	switch n.ipVersion {
+	case "":
+		networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	case "ipv4":
+		networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeUDP4}
+	case "ipv6":
+		networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeUDP6}
+	default:
+		return se, nil, fmt.Errorf("network %q should be ipv4 or ipv6", n.ipVersion)
+	}
+	if n.tcpPort != 0 {
+		if n.ipVersion != "ipv6" {
+			networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4)
+		}
+		if n.ipVersion != "ipv4" {
+			networkTypes = append(networkTypes, webrtc.NetworkTypeTCP6)
+		}
+	}
+	if n.ipVersion != "" || n.tcpPort != 0 {
+		se.SetNetworkTypes(networkTypes)
+	}
+
+	switch n.mdns {
+	case "":
+	case "disabled":
+		se.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	case "query":
+		se.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryOnly)
+	case "gather":
+		se.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryAndGather)
+	default:
+		return se, nil, fmt.Errorf("mdns mode %q should be disabled, query or gather", n.mdns)
+	}
+
+	if n.udpPort != 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: n.udpPort})
+		if err != nil {
+			return se, nil, err
+		}
+		mux := ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: conn})
+		se.SetICEUDPMux(mux)
+		closers = append(closers, mux)
+	}
+	if n.tcpPort != 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: n.tcpPort})
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+			return se, nil, err
+		}
+		// Passive ICE-TCP: the remote peer dials us and sends STUN
+		// framed per RFC 4571 on the connection.
+		mux := ice.NewTCPMuxDefault(ice.TCPMuxParams{Listener: listener, ReadBufferSize: 8})
+		se.SetICETCPMux(mux)
+		closers = append(closers, mux)
+	}
+	return se, closers, nil
+}
+
+// interfaceFilter allows the interfaces named by -interfaces that have an
+// address in one of the -ips networks. It is nil when neither is set.
+func (n networkOptions) interfaceFilter() (func(string) bool, error) {
+	names := splitList(n.interfaces)
+	var nets []*net.IPNet
+	for _, cidr := range splitList(n.ipNets) {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	if len(names) == 0 && len(nets) == 0 {
+		return nil, nil
+	}
+	return func(name string) bool {
+		if len(names) > 0 && !containsString(names, name) {
+			return false
+		}
+		if len(nets) == 0 {
+			return true
+		}
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return false
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, allowed := range nets {
+				if allowed.Contains(ipNet.IP) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// connectPeers creates peer connections for host and client, negotiates
+// between them, and waits for the host to receive the client's data channel.
+// It returns both ends of the data channel.
+func connectPeers(t *testing.T, host, client *session) (hostDC, clientDC *webrtc.DataChannel) {
+	for _, s := range []*session{host, client} {
+		if err := s.createPeerConnection(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opened := make(chan *webrtc.DataChannel, 1)
+	host.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() { opened <- dc })
+	})
+	clientDC, err := client.pc.CreateDataChannel("data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(client.pc)
+	if err = client.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	if err = host.pc.SetRemoteDescription(*client.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := host.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete = webrtc.GatheringCompletePromise(host.pc)
+	if err = host.pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	if err = client.pc.SetRemoteDescription(*host.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case hostDC = <-opened:
+	case <-time.After(10 * time.Second):
+		t.Fatal("peers didn't connect")
+	}
+	return hostDC, clientDC
+}
+
+// candidatePorts lists the ports of the candidates in an SDP.
+func candidatePorts(t *testing.T, sdp string) (ports []int) {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		port, err := strconv.Atoi(fields[5])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, port)
+	}
+	return
+}
+
+func TestSettingEngineErrors(t *testing.T) {
+	for _, n := range []networkOptions{
+		{portRange: "50000"},
+		{portRange: "50100-50000"},
+		{portRange: "a-b"},
+		{ipVersion: "ipv5"},
+		{mdns: "sometimes"},
+		{ipNets: "10.0.0.0/33"},
+	} {
+		if _, _, err := n.settingEngine(); err == nil {
+			t.Errorf("%+v should be invalid", n)
+		}
+	}
+}
+
+func TestInterfaceFilter(t *testing.T) {
+	filter, err := networkOptions{}.interfaceFilter()
+	if filter != nil || err != nil {
+		t.Error("no options means no filter")
+	}
+	filter, _ = networkOptions{interfaces: "eth0, wg0"}.interfaceFilter()
+	if !filter("wg0") || filter("docker0") {
+		t.Error("only named interfaces should be allowed")
+	}
+	filter, _ = networkOptions{ipNets: "127.0.0.1"}.interfaceFilter()
+	if filter("no-such-interface") {
+		t.Error("unknown interfaces should be filtered")
+	}
+}
+
+// freePort finds a port that is free right now on network, "udp" or "tcp".
+func freePort(t *testing.T, network string) int {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestPortRangeAndUDPMux(t *testing.T) {
+	muxPort := freePort(t, "udp")
+	// A range of one free port, since free ranges can't be found.
+	clientPort := freePort(t, "udp")
+	host := session{network: networkOptions{udpPort: muxPort}}
+	client := session{network: networkOptions{portRange: fmt.Sprintf("%d-%d", clientPort, clientPort)}}
+	connectPeers(t, &host, &client)
+	defer host.cleanup()
+	defer client.cleanup()
+
+	hostPorts := candidatePorts(t, host.pc.LocalDescription().SDP)
+	if len(hostPorts) == 0 {
+		t.Fatal("host has no candidates")
+	}
+	for _, port := range hostPorts {
+		if port != muxPort {
+			t.Error("host candidates should all use the mux port", port)
+		}
+	}
+	for _, port := range candidatePorts(t, client.pc.LocalDescription().SDP) {
+		if port != clientPort {
+			t.Error("client candidate outside the port range", port)
+		}
+	}
+}
+
+func TestICETCPCandidates(t *testing.T) {
+	tcpPort := freePort(t, "tcp")
+	host := session{network: networkOptions{tcpPort: tcpPort}}
+	if err := host.createPeerConnection(); err != nil {
+		t.Fatal(err)
+	}
+	defer host.cleanup()
+	if _, err := host.pc.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := host.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(host.pc)
+	if err = host.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+
+	sdp := host.pc.LocalDescription().SDP
+	if !strings.Contains(sdp, " tcp ") || !strings.Contains(sdp, fmt.Sprintf("%d typ host tcptype passive", tcpPort)) {
+		t.Error("offer should have passive TCP candidates on the ICE-TCP port", sdp)
+	}
+	if !strings.Contains(sdp, " udp ") {
+		t.Error("offer should still have UDP candidates", sdp)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	if err != nil {
+		t.Fatal("ICE-TCP port should accept connections", err)
+	}
+	conn.Close()
+}
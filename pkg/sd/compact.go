@@ -0,0 +1,529 @@
+package sd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A compact SDP only keeps what a webtty data channel session needs to
+// connect: the ICE credentials, the DTLS fingerprint and setup role, and the
+// candidates. Everything else is rebuilt from a fixed template on decode.
+//
+// Packed layout, all strings and byte slices are uvarint length prefixed:
+//
+//	setup byte | mid | ufrag | pwd | hash byte [hash name] | fingerprint |
+//	sctp-port uvarint | max-message-size uvarint | flags byte |
+//	candidate count uvarint | candidates...
+
+var errNotPackable = errors.New("sdp can't be packed")
+
+const (
+	payloadPacked byte = 1
+	payloadZlib   byte = 2
+)
+
+const endOfCandidatesFlag byte = 1
+
+var setupRoles = []string{"actpass", "active", "passive"}
+
+var hashNames = []string{"", "sha-256", "sha-1", "sha-384", "sha-512"}
+
+var candidateTypes = []string{"host", "srflx", "prflx", "relay"}
+
+var tcpTypes = []string{"", "active", "passive", "so"}
+
+// Candidate header bits, the low two bits are the candidate type.
+const (
+	candTCP            byte = 1 << 2
+	candComponentOne   byte = 1 << 3
+	candComponentTwo   byte = 1 << 4
+	candRelated        byte = 1 << 5
+	candFoundationText byte = 1 << 6
+)
+
+type packedCandidate struct {
+	foundation string
+	components byte
+	tcp        bool
+	priority   uint64
+	address    string
+	port       uint64
+	typ        byte
+	raddr      string
+	rport      uint64
+	tcpType    byte
+}
+
+type packedSDP struct {
+	setup           byte
+	mid             string
+	ufrag           string
+	pwd             string
+	hash            string
+	fingerprint     []byte
+	sctpPort        uint64
+	maxMessageSize  uint64
+	endOfCandidates bool
+	candidates      []packedCandidate
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseCandidate(value string) (c packedCandidate, component string, err error) {
+	f := strings.Fields(value)
+	if len(f) < 8 || f[6] != "typ" {
+		return c, "", errNotPackable
+	}
+	c.foundation = f[0]
+	component = f[1]
+	switch strings.ToLower(f[2]) {
+	case "udp":
+	case "tcp":
+		c.tcp = true
+	default:
+		return c, "", errNotPackable
+	}
+	if c.priority, err = strconv.ParseUint(f[3], 10, 32); err != nil {
+		return c, "", errNotPackable
+	}
+	c.address = f[4]
+	if c.port, err = strconv.ParseUint(f[5], 10, 16); err != nil {
+		return c, "", errNotPackable
+	}
+	typ := indexOf(candidateTypes, f[7])
+	if typ < 0 {
+		return c, "", errNotPackable
+	}
+	c.typ = byte(typ)
+	// Extensions come in key value pairs, we keep the ones that change
+	// how the candidate is used and drop the informational ones.
+	for i := 8; i+1 < len(f); i += 2 {
+		switch f[i] {
+		case "raddr":
+			c.raddr = f[i+1]
+		case "rport":
+			if c.rport, err = strconv.ParseUint(f[i+1], 10, 16); err != nil {
+				return c, "", errNotPackable
+			}
+		case "tcptype":
+			tcpType := indexOf(tcpTypes, f[i+1])
+			if tcpType <= 0 {
+				return c, "", errNotPackable
+			}
+			c.tcpType = byte(tcpType)
+		}
+	}
+	return c, component, nil
+}
+
+func addCandidate(p *packedSDP, value string) error {
+	c, component, err := parseCandidate(value)
+	if err != nil {
+		return err
+	}
+	var bit byte
+	switch component {
+	case "1":
+		bit = candComponentOne
+	case "2":
+		bit = candComponentTwo
+	default:
+		return errNotPackable
+	}
+	// pion repeats every candidate for the RTCP component, store those once.
+	for i := range p.candidates {
+		other := p.candidates[i]
+		other.components = 0
+		if other == c {
+			p.candidates[i].components |= bit
+			return nil
+		}
+	}
+	c.components = bit
+	p.candidates = append(p.candidates, c)
+	return nil
+}
+
+func parseSDP(sdp string) (p packedSDP, err error) {
+	p.setup = 0xff
+	var media int
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'm':
+			media++
+			f := strings.Fields(value)
+			if len(f) < 4 || f[0] != "application" ||
+				f[2] != "UDP/DTLS/SCTP" || f[3] != "webrtc-datachannel" {
+				return p, errNotPackable
+			}
+		case 'a':
+			name := value
+			attr := ""
+			if i := strings.IndexByte(value, ':'); i >= 0 {
+				name, attr = value[:i], value[i+1:]
+			}
+			switch name {
+			case "ice-lite":
+				return p, errNotPackable
+			case "setup":
+				setup := indexOf(setupRoles, attr)
+				if setup < 0 {
+					return p, errNotPackable
+				}
+				p.setup = byte(setup)
+			case "mid":
+				p.mid = attr
+			case "ice-ufrag":
+				p.ufrag = attr
+			case "ice-pwd":
+				p.pwd = attr
+			case "fingerprint":
+				f := strings.Fields(attr)
+				if len(f) != 2 {
+					return p, errNotPackable
+				}
+				p.hash = strings.ToLower(f[0])
+				if p.fingerprint, err = hex.DecodeString(
+					strings.Replace(f[1], ":", "", -1)); err != nil {
+					return p, errNotPackable
+				}
+			case "sctp-port":
+				if p.sctpPort, err = strconv.ParseUint(attr, 10, 16); err != nil {
+					return p, errNotPackable
+				}
+			case "max-message-size":
+				if p.maxMessageSize, err = strconv.ParseUint(attr, 10, 64); err != nil {
+					return p, errNotPackable
+				}
+			case "candidate":
+				if err = addCandidate(&p, attr); err != nil {
+					return
+				}
+			case "end-of-candidates":
+				p.endOfCandidates = true
+			}
+		}
+	}
+	if media != 1 || p.setup == 0xff || p.ufrag == "" || p.pwd == "" ||
+		len(p.fingerprint) == 0 {
+		return p, errNotPackable
+	}
+	return p, nil
+}
+
+type packWriter struct {
+	bytes.Buffer
+}
+
+func (w *packWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (w *packWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.Write(b)
+}
+
+func (w *packWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+// address stores IPs in their binary form and anything else, like mDNS
+// hostnames, as a string.
+func (w *packWriter) address(addr string) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		w.WriteByte(0)
+		w.string(addr)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		w.WriteByte(4)
+		w.Write(ip4)
+	} else {
+		w.WriteByte(6)
+		w.Write(ip)
+	}
+}
+
+type packReader struct {
+	*bytes.Reader
+	err error
+}
+
+func (r *packReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	var b byte
+	b, r.err = r.ReadByte()
+	return b
+}
+
+func (r *packReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint64
+	v, r.err = binary.ReadUvarint(r)
+	return v
+}
+
+func (r *packReader) fixed(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	// Compared before any conversion, so huge lengths can't wrap around.
+	if n > uint64(r.Len()) {
+		r.err = errors.New("packed data is truncated")
+		return nil
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func (r *packReader) bytes() []byte {
+	return r.fixed(r.uvarint())
+}
+
+func (r *packReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *packReader) address() string {
+	switch r.byte() {
+	case 0:
+		return r.string()
+	case 4:
+		return net.IP(r.fixed(net.IPv4len)).String()
+	case 6:
+		return net.IP(r.fixed(net.IPv6len)).String()
+	}
+	if r.err == nil {
+		r.err = errors.New("unknown address type")
+	}
+	return ""
+}
+
+func packSDP(sdp string) ([]byte, error) {
+	p, err := parseSDP(sdp)
+	if err != nil {
+		return nil, err
+	}
+	var w packWriter
+	w.WriteByte(p.setup)
+	w.string(p.mid)
+	w.string(p.ufrag)
+	w.string(p.pwd)
+	hash := indexOf(hashNames, p.hash)
+	if hash < 0 {
+		hash = 0
+	}
+	w.WriteByte(byte(hash))
+	if hash == 0 {
+		w.string(p.hash)
+	}
+	w.bytes(p.fingerprint)
+	w.uvarint(p.sctpPort)
+	w.uvarint(p.maxMessageSize)
+	var flags byte
+	if p.endOfCandidates {
+		flags |= endOfCandidatesFlag
+	}
+	w.WriteByte(flags)
+	w.uvarint(uint64(len(p.candidates)))
+	for _, c := range p.candidates {
+		header := c.typ | c.components
+		foundation, err := strconv.ParseUint(c.foundation, 10, 32)
+		if err != nil {
+			header |= candFoundationText
+		}
+		if c.tcp {
+			header |= candTCP
+		}
+		if c.raddr != "" {
+			header |= candRelated
+		}
+		w.WriteByte(header)
+		if err != nil {
+			w.string(c.foundation)
+		} else {
+			w.uvarint(foundation)
+		}
+		w.uvarint(c.priority)
+		w.address(c.address)
+		w.uvarint(c.port)
+		if c.raddr != "" {
+			w.address(c.raddr)
+			w.uvarint(c.rport)
+		}
+		if c.tcp {
+			w.WriteByte(c.tcpType)
+		}
+	}
+	return w.Bytes(), nil
+}
+
+func unpackSDP(b []byte) (string, error) {
+	r := packReader{Reader: bytes.NewReader(b)}
+	var p packedSDP
+	p.setup = r.byte()
+	p.mid = r.string()
+	p.ufrag = r.string()
+	p.pwd = r.string()
+	hash := int(r.byte())
+	if hash > 0 && hash < len(hashNames) {
+		p.hash = hashNames[hash]
+	} else {
+		p.hash = r.string()
+	}
+	p.fingerprint = r.bytes()
+	p.sctpPort = r.uvarint()
+	p.maxMessageSize = r.uvarint()
+	p.endOfCandidates = r.byte()&endOfCandidatesFlag != 0
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		var c packedCandidate
+		header := r.byte()
+		c.typ = header & 3
+		c.components = header & (candComponentOne | candComponentTwo)
+		c.tcp = header&candTCP != 0
+		if header&candFoundationText != 0 {
+			c.foundation = r.string()
+		} else {
+			c.foundation = strconv.FormatUint(r.uvarint(), 10)
+		}
+		c.priority = r.uvarint()
+		c.address = r.address()
+		c.port = r.uvarint()
+		if header&candRelated != 0 {
+			c.raddr = r.address()
+			c.rport = r.uvarint()
+		}
+		if c.tcp {
+			c.tcpType = r.byte()
+		}
+		p.candidates = append(p.candidates, c)
+	}
+	if r.err != nil {
+		return "", r.err
+	}
+	if int(p.setup) >= len(setupRoles) {
+		return "", errors.New("unknown setup role")
+	}
+	return p.String(), nil
+}
+
+// String rebuilds the SDP in the same shape pion generates.
+func (p packedSDP) String() string {
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format+"\r\n", a...)
+	}
+	fingerprint := strings.ToUpper(hex.EncodeToString(p.fingerprint))
+	pairs := make([]string, 0, len(p.fingerprint))
+	for i := 0; i+2 <= len(fingerprint); i += 2 {
+		pairs = append(pairs, fingerprint[i:i+2])
+	}
+
+	line("v=0")
+	line("o=- 0 0 IN IP4 0.0.0.0")
+	line("s=-")
+	line("t=0 0")
+	line("a=fingerprint:%s %s", p.hash, strings.Join(pairs, ":"))
+	line("a=group:BUNDLE %s", p.mid)
+	line("m=application 9 UDP/DTLS/SCTP webrtc-datachannel")
+	line("c=IN IP4 0.0.0.0")
+	line("a=setup:%s", setupRoles[p.setup])
+	line("a=mid:%s", p.mid)
+	line("a=sendrecv")
+	if p.sctpPort != 0 {
+		line("a=sctp-port:%d", p.sctpPort)
+	}
+	if p.maxMessageSize != 0 {
+		line("a=max-message-size:%d", p.maxMessageSize)
+	}
+	line("a=ice-ufrag:%s", p.ufrag)
+	line("a=ice-pwd:%s", p.pwd)
+	for _, c := range p.candidates {
+		for _, component := range []byte{candComponentOne, candComponentTwo} {
+			if c.components&component == 0 {
+				continue
+			}
+			id := 1
+			if component == candComponentTwo {
+				id = 2
+			}
+			network := "udp"
+			if c.tcp {
+				network = "tcp"
+			}
+			cand := fmt.Sprintf("a=candidate:%s %d %s %d %s %d typ %s",
+				c.foundation, id, network, c.priority, c.address, c.port,
+				candidateTypes[c.typ])
+			if c.raddr != "" {
+				cand += fmt.Sprintf(" raddr %s rport %d", c.raddr, c.rport)
+			}
+			if c.tcp && int(c.tcpType) < len(tcpTypes) && c.tcpType != 0 {
+				cand += " tcptype " + tcpTypes[c.tcpType]
+			}
+			line("%s", cand)
+		}
+	}
+	if p.endOfCandidates {
+		line("a=end-of-candidates")
+	}
+	return b.String()
+}
+
+// packPayload packs an SDP if it fits the compact template and otherwise
+// falls back to compressing the full text.
+func packPayload(sdp string) []byte {
+	if packed, err := packSDP(sdp); err == nil {
+		return append([]byte{payloadPacked}, packed...)
+	}
+	var b bytes.Buffer
+	b.WriteByte(payloadZlib)
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(sdp))
+	w.Close()
+	return b.Bytes()
+}
+
+func unpackPayload(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", errors.New("empty payload")
+	}
+	switch b[0] {
+	case payloadPacked:
+		return unpackSDP(b[1:])
+	case payloadZlib:
+		r, err := zlib.NewReader(bytes.NewReader(b[1:]))
+		if err != nil {
+			return "", err
+		}
+		text, err := ioutil.ReadAll(r)
+		return string(text), err
+	}
+	return "", fmt.Errorf("unknown payload type %d", b[0])
+}
@@ -0,0 +1,269 @@
+package sd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/pion/webrtc/v3"
+)
+
+// A browser answer with the kinds of candidates pion doesn't produce on a
+// test machine: mDNS hostnames, server reflexive and TCP candidates.
+var browserSdp = strings.Join([]string{
+	"v=0",
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1",
+	"s=-",
+	"t=0 0",
+	"a=group:BUNDLE 0",
+	"a=extmap-allow-mixed",
+	"a=msid-semantic: WMS",
+	"m=application 9 UDP/DTLS/SCTP webrtc-datachannel",
+	"c=IN IP4 0.0.0.0",
+	"a=candidate:3324430125 1 udp 2113937151 0b6e5a6f-b7e9-4b6c-9f55-e6c2b1a0c2f5.local 54400 typ host generation 0 network-cost 999",
+	"a=candidate:842163049 1 udp 1677729535 203.0.113.7 54400 typ srflx raddr 0.0.0.0 rport 0 generation 0 network-cost 999",
+	"a=candidate:1510613869 1 tcp 1518280447 2001:db8::1 9 typ host tcptype active generation 0",
+	"a=ice-ufrag:WfBm",
+	"a=ice-pwd:a1K9hnYb2jy+kzP4gWD7Q8pR",
+	"a=ice-options:trickle",
+	"a=fingerprint:sha-256 5E:6F:83:11:2A:9C:D0:40:52:7B:AE:19:3C:F1:08:6D:77:20:E4:B5:C9:01:3A:8F:62:D3:4B:97:AA:1C:E0:55",
+	"a=setup:active",
+	"a=mid:0",
+	"a=sctp-port:5000",
+	"a=max-message-size:262144",
+	"",
+}, "\r\n")
+
+func encodeLegacy(offer SessionDescription) string {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(offer.Sdp))
+	w.Close()
+	offer.Sdp = base58.Encode(b.Bytes())
+	offerBytes, _ := json.Marshal(offer)
+	return base58.Encode(offerBytes)
+}
+
+func gatheredDescription(t *testing.T, pc *webrtc.PeerConnection, desc webrtc.SessionDescription) string {
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	return pc.LocalDescription().SDP
+}
+
+func assertRoundTrip(t *testing.T, sdp string) {
+	packed, err := packSDP(sdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := unpackSDP(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := parseSDP(sdp)
+	got, err := parseSDP(unpacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("round trip mismatch\nwant %+v\ngot  %+v", want, got)
+	}
+}
+
+func TestPackSDPRoundTrip(t *testing.T) {
+	assertRoundTrip(t, browserSdp)
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err = pc.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRoundTrip(t, gatheredDescription(t, pc, offer))
+}
+
+func TestPackBrowserSDP(t *testing.T) {
+	packed, err := packSDP(browserSdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := unpackSDP(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"a=candidate:3324430125 1 udp 2113937151 0b6e5a6f-b7e9-4b6c-9f55-e6c2b1a0c2f5.local 54400 typ host",
+		"a=candidate:842163049 1 udp 1677729535 203.0.113.7 54400 typ srflx raddr 0.0.0.0 rport 0",
+		"a=candidate:1510613869 1 tcp 1518280447 2001:db8::1 9 typ host tcptype active",
+		"a=setup:active",
+		"a=max-message-size:262144",
+	} {
+		if !strings.Contains(unpacked, line+"\r\n") {
+			t.Errorf("missing %q in\n%s", line, unpacked)
+		}
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  strings.Replace(unpacked, "a=setup:active", "a=setup:actpass", 1),
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnpackableSDPFallsBack(t *testing.T) {
+	sdp := strings.Replace(browserSdp, "m=application 9 UDP/DTLS/SCTP webrtc-datachannel",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111", 1)
+	if _, err := packSDP(sdp); err != errNotPackable {
+		t.Error("audio sections shouldn't pack", err)
+	}
+	decoded, err := Decode(Encode(SessionDescription{Sdp: sdp}))
+	if err != nil {
+		t.Error(err)
+	}
+	if decoded.Sdp != sdp {
+		t.Error("fallback encoding should keep the sdp as is")
+	}
+}
+
+func TestCompactEncodingIsShorter(t *testing.T) {
+	offer := SessionDescription{Sdp: browserSdp}
+	offer.SetExpiry(time.Minute)
+	compact, legacy := Encode(offer), encodeLegacy(offer)
+	if len(compact)*3 > len(legacy) {
+		t.Errorf("compact encoding is %d chars, legacy is %d", len(compact), len(legacy))
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	offer := SessionDescription{Sdp: browserSdp, TenKbSiteLoc: "loc", TTL: 60}
+	sd, err := Decode(encodeLegacy(offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sd, offer) {
+		t.Error("legacy decode mismatch", sd)
+	}
+}
+
+func TestCompactConnect(t *testing.T) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offerer.Close()
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answerer.Close()
+
+	received := make(chan string, 1)
+	answerer.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			received <- string(msg.Data)
+		})
+	})
+	dc, err := offerer.CreateDataChannel("data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.OnOpen(func() {
+		dc.SendText("hello")
+	})
+
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := SessionDescription{}
+	key.GenKeys()
+	encoded := SessionDescription{
+		Sdp: gatheredDescription(t, offerer, offer), Key: key.Key, Nonce: key.Nonce}
+	if err = encoded.Encrypt(); err != nil {
+		t.Fatal(err)
+	}
+	decodedOffer, err := Decode(Encode(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = decodedOffer.Decrypt(); err != nil {
+		t.Fatal(err)
+	}
+	if err = answerer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer, SDP: decodedOffer.Sdp}); err != nil {
+		t.Fatal(err)
+	}
+
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedAnswer, err := Decode(Encode(SessionDescription{
+		Sdp: gatheredDescription(t, answerer, answer)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = offerer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer, SDP: decodedAnswer.Sdp}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-received:
+		if msg != "hello" {
+			t.Error(msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("peers didn't connect")
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	valid := base58.Decode(Encode(SessionDescription{Sdp: browserSdp, Created: 1, TTL: 60}))
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+
+	// A packed SDP whose first string claims to be 1<<63 or more bytes long.
+	hugeSDP := []byte{payloadPacked, 0}
+	hugeSDP = append(hugeSDP, huge...)
+	var w packWriter
+	w.WriteByte(encodingVersion)
+	w.WriteByte(fieldSdp)
+	w.bytes(hugeSDP)
+
+	for name, data := range map[string][]byte{
+		"empty":              {},
+		"truncated":          valid[:len(valid)/2],
+		"truncated field":    {encodingVersion, fieldTenKbSiteLoc, 10, 'a'},
+		"huge field length":  append([]byte{encodingVersion, fieldTenKbSiteLoc}, huge...),
+		"huge sdp length":    w.Bytes(),
+		"bad varint":         append([]byte{encodingVersion, fieldTTL}, huge[:9]...),
+		"unknown version":    {9, 1, 2, 3},
+		"unknown payload":    {encodingVersion, fieldSdp, 2, 9, 9},
+		"garbage":            []byte("\x01\x01\x06\x01\xee\xee\xee\xee\xee"),
+		"garbage legacy":     []byte("{not json"),
+		"empty sdp payload":  {encodingVersion, fieldSdp, 0},
+		"unknown setup role": {encodingVersion, fieldSdp, 12, payloadPacked, 9, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := Decode(base58.Encode(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
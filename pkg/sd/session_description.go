@@ -6,27 +6,125 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/btcsuite/btcutil/base58"
 )
 
+// encodingVersion prefixes compact encodings. Legacy encodings are base58
+// JSON and so always start with '{'.
+const encodingVersion byte = 1
+
+// Field tags. Tags with hexField set carry hex strings in their binary form.
+const (
+	fieldSdp byte = iota + 1
+	fieldTenKbSiteLoc
+	fieldKey
+	fieldNonce
+	fieldCreated
+	fieldTTL
+	fieldExec
+
+	hexField byte = 0x80
+)
+
+func writeStringField(w *packWriter, tag byte, s string) {
+	if s == "" {
+		return
+	}
+	if b, err := hex.DecodeString(s); err == nil && hex.EncodeToString(b) == s {
+		w.WriteByte(tag | hexField)
+		w.bytes(b)
+		return
+	}
+	w.WriteByte(tag)
+	if tag == fieldSdp {
+		w.bytes(packPayload(s))
+	} else {
+		w.string(s)
+	}
+}
+
+func writeIntField(w *packWriter, tag byte, v int64) {
+	if v == 0 {
+		return
+	}
+	var b [binary.MaxVarintLen64]byte
+	w.WriteByte(tag)
+	w.bytes(b[:binary.PutVarint(b[:], v)])
+}
+
+// Encode packs a session description into a base58 string. Plaintext SDPs
+// are reduced to the essentials needed to connect, see packSDP.
 func Encode(offer SessionDescription) string {
-	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	w.Write([]byte(offer.Sdp))
-	w.Close()
-	offer.Sdp = base58.Encode(b.Bytes())
-	offerBytes, _ := json.Marshal(offer)
-	return base58.Encode(offerBytes)
+	var w packWriter
+	w.WriteByte(encodingVersion)
+	writeStringField(&w, fieldSdp, offer.Sdp)
+	writeStringField(&w, fieldTenKbSiteLoc, offer.TenKbSiteLoc)
+	writeStringField(&w, fieldKey, offer.Key)
+	writeStringField(&w, fieldNonce, offer.Nonce)
+	writeIntField(&w, fieldCreated, offer.Created)
+	writeIntField(&w, fieldTTL, offer.TTL)
+	if offer.Exec {
+		writeIntField(&w, fieldExec, 1)
+	}
+	return base58.Encode(w.Bytes())
 }
 
 func Decode(offer string) (sd SessionDescription, err error) {
 	decodeBytes := base58.Decode(offer)
+	if len(decodeBytes) > 0 && decodeBytes[0] == '{' {
+		return decodeLegacy(decodeBytes)
+	}
+	if len(decodeBytes) == 0 || decodeBytes[0] != encodingVersion {
+		return sd, errors.New("unknown session description encoding")
+	}
+	r := packReader{Reader: bytes.NewReader(decodeBytes[1:])}
+	for r.Len() > 0 && r.err == nil {
+		tag := r.byte()
+		value := r.bytes()
+		if r.err != nil {
+			break
+		}
+		text := string(value)
+		if tag&hexField != 0 {
+			text = hex.EncodeToString(value)
+		} else if tag == fieldSdp {
+			if text, err = unpackPayload(value); err != nil {
+				return
+			}
+		}
+		switch tag &^ hexField {
+		case fieldSdp:
+			sd.Sdp = text
+		case fieldTenKbSiteLoc:
+			sd.TenKbSiteLoc = text
+		case fieldKey:
+			sd.Key = text
+		case fieldNonce:
+			sd.Nonce = text
+		case fieldCreated:
+			sd.Created, _ = binary.Varint(value)
+		case fieldTTL:
+			sd.TTL, _ = binary.Varint(value)
+		case fieldExec:
+			exec, _ := binary.Varint(value)
+			sd.Exec = exec != 0
+		}
+	}
+	return sd, r.err
+}
+
+// decodeLegacy reads the original encoding: base58 JSON with a zlib
+// compressed, base58 encoded SDP.
+func decodeLegacy(decodeBytes []byte) (sd SessionDescription, err error) {
 	if err = json.Unmarshal(decodeBytes, &sd); err != nil {
 		return
 	}
@@ -44,11 +142,41 @@ func Decode(offer string) (sd SessionDescription, err error) {
 	return
 }
 
+// ErrExpired is returned when a session description is used after its TTL
+// has passed.
+var ErrExpired = errors.New("session description has expired")
+
+// ClockSkew is how far the clock of whoever checks a description may be
+// ahead of the clock of whoever made it. Hosts check their own offers against
+// when they made them, so it only matters to clients.
+const ClockSkew = time.Minute
+
 type SessionDescription struct {
 	Sdp          string
 	TenKbSiteLoc string
 	Key          string
 	Nonce        string
+	// Created is the unix time the description was made and TTL the number
+	// of seconds it stays valid for. A zero TTL never expires.
+	Created int64
+	TTL     int64
+	// Exec offers run the command with pipes instead of a terminal.
+	Exec bool
+}
+
+// SetExpiry stamps the description with the current time and a ttl.
+func (sd *SessionDescription) SetExpiry(ttl time.Duration) {
+	sd.Created = time.Now().Unix()
+	sd.TTL = int64(ttl / time.Second)
+}
+
+// Expired reports whether the description is past its TTL, allowing for
+// ClockSkew.
+func (sd *SessionDescription) Expired() bool {
+	if sd.TTL <= 0 {
+		return false
+	}
+	return time.Now().Unix() > sd.Created+sd.TTL+int64(ClockSkew/time.Second)
 }
 
 func (sd *SessionDescription) GenKeys() (err error) {
@@ -89,7 +217,8 @@ func (sd *SessionDescription) Encrypt() (err error) {
 		return
 	}
 
-	sd.Sdp = hex.EncodeToString(aesgcm.Seal(nil, nonce, []byte(sd.Sdp), nil))
+	plaintext := packPayload(sd.Sdp)
+	sd.Sdp = hex.EncodeToString(aesgcm.Seal(nil, nonce, plaintext, nil))
 	return
 }
 
@@ -127,6 +256,11 @@ func (sd *SessionDescription) Decrypt() (err error) {
 		log.Println(err)
 		return
 	}
-	sd.Sdp = string(plaintext)
+	// Older versions encrypted the SDP text as is
+	if bytes.HasPrefix(plaintext, []byte("v=")) {
+		sd.Sdp = string(plaintext)
+		return
+	}
+	sd.Sdp, err = unpackPayload(plaintext)
 	return
 }
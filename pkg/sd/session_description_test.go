@@ -2,6 +2,7 @@ package sd
 
 import (
 	"testing"
+	"time"
 )
 
 func TestEncodeDecode(t *testing.T) {
@@ -39,3 +40,42 @@ func TestEncryptAndDecrypt(t *testing.T) {
 	}
 
 }
+
+func TestExpired(t *testing.T) {
+	sd := SessionDescription{}
+	if sd.Expired() {
+		t.Error("zero TTL should never expire")
+	}
+	sd.SetExpiry(time.Minute)
+	if sd.Expired() {
+		t.Error("should not have expired yet")
+	}
+	offer := Encode(sd)
+	sd, err := Decode(offer)
+	if err != nil {
+		t.Error(err)
+	}
+	if sd.TTL != 60 || sd.Created == 0 {
+		t.Error("expiry not encoded", sd.Created, sd.TTL)
+	}
+	sd.Created -= 61
+	if sd.Expired() {
+		t.Error("clock skew should be allowed for")
+	}
+	sd.Created -= int64(ClockSkew / time.Second)
+	if !sd.Expired() {
+		t.Error("should have expired")
+	}
+}
+
+func TestExecEncoding(t *testing.T) {
+	for _, exec := range []bool{false, true} {
+		sd, err := Decode(Encode(SessionDescription{Sdp: "v=0", Exec: exec}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sd.Exec != exec {
+			t.Errorf("Exec %t decoded as %t", exec, sd.Exec)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import "bytes"
+
+// prediction is one keystroke the predictor expects the host to echo.
+type prediction struct {
+	expect  []byte
+	display []byte
+	undo    []byte
+	shown   bool
+}
+
+// predictor speculatively echoes typing on slow links, like mosh. Typed
+// printable characters and left arrows are drawn straight away, printable
+// characters underlined until the host's echo confirms them.
+//
+// Predictions are only shown once the host has been seen to echo typing.
+// Any other input, or host output that doesn't match, drops the outstanding
+// predictions and stops showing them until the next keystroke is confirmed.
+type predictor struct {
+	pending []prediction
+	trusted bool
+}
+
+// userInput records typed input and returns what to draw for it.
+func (p *predictor) userInput(in []byte) (draw []byte) {
+	for i := 0; i < len(in); i++ {
+		var pred prediction
+		switch b := in[i]; {
+		case b >= 0x20 && b < 0x7f:
+			pred = prediction{
+				expect:  []byte{b},
+				display: []byte{0x1b, '[', '4', 'm', b, 0x1b, '[', '2', '4', 'm'},
+				undo:    []byte("\b\x1b[X"),
+			}
+		case b == 0x1b && i+2 < len(in) && (in[i+1] == '[' || in[i+1] == 'O') && in[i+2] == 'D':
+			i += 2
+			pred = prediction{expect: []byte("\b"), display: []byte("\b"), undo: []byte("\x1b[C")}
+		default:
+			// Enter, control keys and other escape sequences do things we
+			// can't predict.
+			p.trusted = false
+			return
+		}
+		if p.trusted {
+			pred.shown = true
+			draw = append(draw, pred.display...)
+		}
+		p.pending = append(p.pending, pred)
+	}
+	return
+}
+
+// hostOutput reconciles output from the host with the predictions and
+// returns what to write to the terminal.
+func (p *predictor) hostOutput(data []byte) (out []byte) {
+	if len(p.pending) == 0 {
+		return data
+	}
+	// Put the screen back the way the host left it, write the output, then
+	// redraw whatever is still unconfirmed.
+	for i := len(p.pending) - 1; i >= 0; i-- {
+		if p.pending[i].shown {
+			out = append(out, p.pending[i].undo...)
+		}
+	}
+	out = append(out, data...)
+
+	rest := data
+	for len(p.pending) > 0 && len(rest) > 0 {
+		expect := p.pending[0].expect
+		if !bytes.HasPrefix(rest, expect) {
+			p.pending = nil
+			p.trusted = false
+			return out
+		}
+		rest = rest[len(expect):]
+		p.pending = p.pending[1:]
+		p.trusted = true
+	}
+	if len(rest) > 0 {
+		// Output after every prediction was confirmed, eg: a redraw of
+		// the rest of the line. Nothing is left to redraw.
+		return out
+	}
+	for i := range p.pending {
+		if p.pending[i].shown {
+			out = append(out, p.pending[i].display...)
+		}
+	}
+	return out
+}
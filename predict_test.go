@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestPredictorNeedsConfirmedEcho(t *testing.T) {
+	var p predictor
+	if draw := p.userInput([]byte("l")); len(draw) != 0 {
+		t.Error("nothing is shown before the host has echoed typing", draw)
+	}
+	if out := p.hostOutput([]byte("l")); string(out) != "l" {
+		t.Errorf("got %q", out)
+	}
+	if draw := p.userInput([]byte("s")); string(draw) != "\x1b[4ms\x1b[24m" {
+		t.Errorf("confirmed echo should enable predictions, got %q", draw)
+	}
+}
+
+func TestPredictorReconciles(t *testing.T) {
+	p := predictor{trusted: true}
+	p.userInput([]byte("ab"))
+
+	// "a" is confirmed, "b" is redrawn after it.
+	out := p.hostOutput([]byte("a"))
+	want := "\b\x1b[X" + "\b\x1b[X" + "a" + "\x1b[4mb\x1b[24m"
+	if string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if len(p.pending) != 1 {
+		t.Error("b should still be pending", p.pending)
+	}
+	if out = p.hostOutput([]byte("b")); string(out) != "\b\x1b[Xb" {
+		t.Errorf("got %q", out)
+	}
+	if out = p.hostOutput([]byte("more")); string(out) != "more" {
+		t.Error("output without predictions passes through", out)
+	}
+}
+
+func TestPredictorMispredicts(t *testing.T) {
+	p := predictor{trusted: true}
+	p.userInput([]byte("x"))
+	out := p.hostOutput([]byte("\a"))
+	if string(out) != "\b\x1b[X\a" {
+		t.Errorf("got %q", out)
+	}
+	if p.trusted || len(p.pending) != 0 {
+		t.Error("a wrong guess should drop predictions until typing is confirmed again")
+	}
+}
+
+func TestPredictorCursorMovement(t *testing.T) {
+	p := predictor{trusted: true}
+	if draw := p.userInput([]byte("\x1b[D")); string(draw) != "\b" {
+		t.Errorf("left arrow should move the cursor, got %q", draw)
+	}
+	if out := p.hostOutput([]byte("\b")); string(out) != "\x1b[C\b" {
+		t.Errorf("got %q", out)
+	}
+	if draw := p.userInput([]byte("\r")); len(draw) != 0 || p.trusted {
+		t.Error("enter can't be predicted")
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+var webClientURL = "https://maxmcd.github.io/webtty/"
+
+// printQR renders content as a QR code drawn with unicode half blocks. The
+// colors suit a terminal with a dark background.
+func printQR(w io.Writer, content string) error {
+	q, err := qrcode.New(content, qrcode.Low)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, q.ToSmallString(false))
+	return err
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintQR(t *testing.T) {
+	var b bytes.Buffer
+	if err := printQR(&b, webClientURL+"#offer"); err != nil {
+		t.Error(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) < 10 {
+		t.Error("qr code is too small", len(lines))
+	}
+	if !strings.ContainsAny(b.String(), "█▀▄") {
+		t.Error("qr code should be drawn with blocks")
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"io"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/maxmcd/webtty/pkg/sd"
 	"github.com/pion/webrtc/v3"
@@ -10,15 +13,27 @@ import (
 )
 
 type session struct {
+	// Accessed atomically, first in the struct for 64-bit alignment.
+	lastSeen int64
+	latency  int64
+
 	// mutex?
 	oldTerminalState *terminal.State
-	stunServers      []string
+	iceServers       []webrtc.ICEServer
+	relayOnly        bool
+	peerTimeout      time.Duration
+	readSize         int
+	batchWindow      time.Duration
+	network          networkOptions
+	closers          []io.Closer
 	errChan          chan error
 	isTerminal       bool
 	pc               *webrtc.PeerConnection
 	offer            sd.SessionDescription
 	answer           sd.SessionDescription
 	dc               *webrtc.DataChannel
+	signal           *signaler
+	heartbeatOnce    sync.Once
 }
 
 func (s *session) init() (err error) {
@@ -43,6 +58,11 @@ func (s *session) cleanup() {
 			log.Println(err)
 		}
 	}
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil {
+			log.Println(err)
+		}
+	}
 
 }
 
@@ -59,15 +79,43 @@ func (s *session) makeRawTerminal() error {
 	return err
 }
 
+// trickle sends local candidates through sig as they are gathered instead
+// of waiting for gathering to complete. It must be called before the local
+// description is set.
+func (s *session) trickle(sig *signaler) {
+	s.signal = sig
+	s.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if err := sig.sendCandidate(c); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// waitForSignaling blocks until the remote peer has sent all of its
+// candidates, so stdin isn't read for input while it still carries them.
+func (s *session) waitForSignaling() {
+	if s.signal != nil {
+		<-s.signal.done
+	}
+}
+
 func (s *session) createPeerConnection() (err error) {
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: s.stunServers,
-			},
-		},
+		ICEServers: s.iceServers,
+	}
+	if s.relayOnly {
+		if !hasTURNServer(s.iceServers) {
+			return errNoRelay
+		}
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
 	}
-	s.pc, err = webrtc.NewPeerConnection(config)
+	se, closers, err := s.network.settingEngine()
+	if err != nil {
+		return
+	}
+	s.closers = append(s.closers, closers...)
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+	s.pc, err = api.NewPeerConnection(config)
 	if err != nil {
 		return
 	}
@@ -80,6 +128,12 @@ func (s *session) createPeerConnection() (err error) {
 	// }
 	s.pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		log.Printf("ICE Connection State has changed: %s\n", connectionState.String())
+		if connectionState == webrtc.ICEConnectionStateFailed {
+			select {
+			case s.errChan <- errICEFailed:
+			default:
+			}
+		}
 	})
 	return
 }
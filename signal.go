@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/maxmcd/webtty/pkg/sd"
+	"github.com/pion/webrtc/v3"
+)
+
+const endOfCandidates = "end-of-candidates"
+
+var errWrongKey = errors.New("couldn't decrypt the session description, check the pairing code")
+
+// A signaler exchanges a session description and trickled ICE candidates
+// with the remote peer over a live channel, one message per line.
+// Descriptions are sent encoded, candidates as their "candidate:" attribute
+// and the end of gathering as "end-of-candidates". Lines that are none of
+// these, like the instructions printed for humans, are skipped.
+type signaler struct {
+	r io.Reader
+	w io.Writer
+	// key, if set, encrypts descriptions with a key both peers already
+	// share. Every description gets a fresh nonce.
+	key string
+
+	mu              sync.Mutex
+	descriptionSent bool
+	pending         []string
+
+	// done is closed once the remote peer has sent all of its candidates,
+	// after that the reader is free to be used for something else.
+	done chan struct{}
+}
+
+func newSignaler(r io.Reader, w io.Writer) *signaler {
+	return &signaler{r: r, w: w, done: make(chan struct{})}
+}
+
+func (s *signaler) writeLine(line string) error {
+	_, err := io.WriteString(s.w, line+"\n")
+	return err
+}
+
+// sendDescription sends the local description followed by any candidates
+// that were gathered before it.
+func (s *signaler) sendDescription(desc sd.SessionDescription) error {
+	if s.key != "" {
+		if err := desc.GenKeys(); err != nil {
+			return err
+		}
+		desc.Key = s.key
+		if err := desc.Encrypt(); err != nil {
+			return err
+		}
+		desc.Key = ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeLine(sd.Encode(desc)); err != nil {
+		return err
+	}
+	s.descriptionSent = true
+	for _, line := range s.pending {
+		if err := s.writeLine(line); err != nil {
+			return err
+		}
+	}
+	s.pending = nil
+	return nil
+}
+
+// sendCandidate sends a local candidate, a nil candidate marks the end of
+// gathering. Candidates are held back until the description is sent.
+func (s *signaler) sendCandidate(c *webrtc.ICECandidate) error {
+	line := endOfCandidates
+	if c != nil {
+		line = c.ToJSON().Candidate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.descriptionSent {
+		s.pending = append(s.pending, line)
+		return nil
+	}
+	return s.writeLine(line)
+}
+
+// readLine reads a byte at a time so nothing past the line is consumed from
+// the underlying reader.
+func (s *signaler) readLine() (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := s.r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return strings.TrimSpace(string(line)), nil
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return strings.TrimSpace(string(line)), nil
+			}
+			return "", err
+		}
+	}
+}
+
+// readDescription waits for the remote session description.
+func (s *signaler) readDescription() (desc sd.SessionDescription, err error) {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return desc, err
+		}
+		if line == "" || strings.HasPrefix(line, "candidate:") ||
+			line == endOfCandidates {
+			continue
+		}
+		if desc, err = sd.Decode(line); err != nil {
+			continue
+		}
+		if s.key != "" {
+			desc.Key = s.key
+			if err = desc.Decrypt(); err != nil {
+				return desc, errWrongKey
+			}
+			desc.Key = ""
+			desc.Nonce = ""
+		}
+		return desc, nil
+	}
+}
+
+// addRemoteCandidates adds candidates to pc as they arrive until the remote
+// peer is done gathering. It must be called after the remote description is
+// set.
+func (s *signaler) addRemoteCandidates(pc *webrtc.PeerConnection) {
+	defer close(s.done)
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return
+		}
+		if line == endOfCandidates {
+			return
+		}
+		if !strings.HasPrefix(line, "candidate:") {
+			continue
+		}
+		if err = pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: line}); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/webtty/pkg/sd"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSignalerHoldsCandidatesForDescription(t *testing.T) {
+	var out bytes.Buffer
+	sig := newSignaler(strings.NewReader(""), &out)
+	if err := sig.sendCandidate(nil); err != nil {
+		t.Error(err)
+	}
+	if out.Len() != 0 {
+		t.Error("candidates shouldn't be sent before the description")
+	}
+	if err := sig.sendDescription(sd.SessionDescription{Sdp: "sdp"}); err != nil {
+		t.Error(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || lines[1] != endOfCandidates {
+		t.Error("wrong lines", lines)
+	}
+	desc, err := newSignaler(strings.NewReader("Some instructions\n"+out.String()), nil).readDescription()
+	if err != nil {
+		t.Error(err)
+	}
+	if desc.Sdp != "sdp" {
+		t.Error(desc)
+	}
+}
+
+func TestTrickleConnect(t *testing.T) {
+	hostIn, clientOut := io.Pipe()
+	clientIn, hostOut := io.Pipe()
+
+	host := session{}
+	client := session{}
+	for _, s := range []*session{&host, &client} {
+		if err := s.createPeerConnection(); err != nil {
+			t.Fatal(err)
+		}
+		pc := s.pc
+		t.Cleanup(func() { pc.Close() })
+	}
+	// Closing the pipes unblocks the signaling goroutines, and candidates
+	// still being sent, before the connections are closed.
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		for _, c := range []io.Closer{hostIn, hostOut, clientIn, clientOut} {
+			c.Close()
+		}
+		wg.Wait()
+	})
+	host.trickle(newSignaler(hostIn, hostOut))
+	client.trickle(newSignaler(clientIn, clientOut))
+
+	opened := make(chan struct{})
+	host.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() { close(opened) })
+	})
+	// The host needs a channel of its own for the offer to have a media
+	// section, as in hostSession.createOffer
+	if _, err := host.pc.CreateDataChannel("offerer-channel", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.pc.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		offer, err := host.pc.CreateOffer(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = host.pc.SetLocalDescription(offer); err != nil {
+			t.Error(err)
+			return
+		}
+		if err = host.signal.sendDescription(sd.SessionDescription{
+			Sdp: host.pc.LocalDescription().SDP}); err != nil {
+			t.Error(err)
+		}
+		answer, err := host.signal.readDescription()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = host.pc.SetRemoteDescription(webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer, SDP: answer.Sdp}); err != nil {
+			t.Error(err)
+		}
+		host.signal.addRemoteCandidates(host.pc)
+	}()
+
+	offer, err := client.signal.readDescription()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(offer.Sdp, "a=candidate") {
+		t.Error("offer shouldn't wait for candidates")
+	}
+	if err = client.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer, SDP: offer.Sdp}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		client.signal.addRemoteCandidates(client.pc)
+	}()
+	answer, err := client.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.signal.sendDescription(sd.SessionDescription{
+		Sdp: client.pc.LocalDescription().SDP}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		t.Fatal("peers didn't connect")
+	}
+	select {
+	case <-client.signal.done:
+	case <-time.After(10 * time.Second):
+		t.Error("signaling should finish after end-of-candidates")
+	}
+}
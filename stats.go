@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// statsInterval is how often -stats refreshes.
+const statsInterval = 2 * time.Second
+
+// connStats is a snapshot of how the connection is doing.
+type connStats struct {
+	rtt           time.Duration
+	local         string
+	remote        string
+	protocol      string
+	bytesSent     uint64
+	bytesReceived uint64
+	buffered      uint64
+}
+
+func (c connStats) String() string {
+	rtt := "-"
+	if c.rtt > 0 {
+		rtt = c.rtt.Round(time.Millisecond).String()
+	}
+	path := "not connected"
+	if c.local != "" {
+		path = fmt.Sprintf("%s/%s %s", c.local, c.remote, c.protocol)
+	}
+	return fmt.Sprintf("rtt %s | %s | sent %s | received %s | buffered %s",
+		rtt, path, humanBytes(c.bytesSent), humanBytes(c.bytesReceived), humanBytes(c.buffered))
+}
+
+// connStats reads the selected candidate pair and the traffic on dc, which
+// may be nil.
+func (s *session) connStats(dc *webrtc.DataChannel) (stats connStats) {
+	report := s.pc.GetStats()
+	if dc != nil {
+		if dcStats, ok := report.GetDataChannelStats(dc); ok {
+			stats.bytesSent = dcStats.BytesSent
+			stats.bytesReceived = dcStats.BytesReceived
+		}
+		stats.buffered = dc.BufferedAmount()
+	}
+
+	sctp := s.pc.SCTP()
+	if sctp == nil {
+		return
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return
+	}
+	stats.local = pair.Local.Typ.String()
+	stats.remote = pair.Remote.Typ.String()
+	stats.protocol = pair.Local.Protocol.String()
+	if pairStats, ok := report.GetICECandidatePairStats(pair); ok {
+		stats.rtt = time.Duration(pairStats.CurrentRoundTripTime * float64(time.Second))
+	}
+	if stats.rtt == 0 {
+		stats.rtt = time.Duration(atomic.LoadInt64(&s.latency))
+	}
+	return
+}
+
+// watchStats calls show with fresh stats every statsInterval until the
+// connection closes.
+func (s *session) watchStats(dc *webrtc.DataChannel, show func(connStats)) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		show(s.connStats(dc))
+	}
+}
+
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
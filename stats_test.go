@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	host := session{}
+	client := session{}
+	connectPeers(t, &host, &client)
+	defer host.pc.Close()
+	defer client.pc.Close()
+
+	// The selected pair is set once ICE has connected.
+	var stats connStats
+	for i := 0; i < 100 && stats.local == ""; i++ {
+		stats = client.connStats(nil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.local != "host" || stats.remote != "host" || stats.protocol != "udp" {
+		t.Errorf("unexpected candidate pair: %+v", stats)
+	}
+	if !strings.Contains(stats.String(), "host/host udp") {
+		t.Error(stats.String())
+	}
+}
+
+func TestConnStatsString(t *testing.T) {
+	stats := connStats{
+		rtt:           23400 * time.Microsecond,
+		local:         "srflx",
+		remote:        "relay",
+		protocol:      "udp",
+		bytesSent:     2048,
+		bytesReceived: 5 * 1024 * 1024,
+	}
+	want := "rtt 23ms | srflx/relay udp | sent 2.0 KB | received 5.0 MB | buffered 0 B"
+	if stats.String() != want {
+		t.Errorf("got %q, want %q", stats.String(), want)
+	}
+	if !strings.Contains(connStats{}.String(), "rtt - | not connected") {
+		t.Error(connStats{}.String())
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hinshun/vt10x"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// syncProtocol is listed in the protocol of the client's data channel
+	// when it wants screen updates on the "sync" channel instead of the
+	// output stream.
+	syncProtocol = "webtty-sync"
+	// syncInterval is how often the host looks for screen changes.
+	syncInterval = 20 * time.Millisecond
+	// syncResend is how long the host waits for an ack before sending the
+	// screen again.
+	syncResend = 250 * time.Millisecond
+	// maxSyncFrames is how many unacknowledged frames the host diffs
+	// against before it falls back to redrawing the whole screen.
+	maxSyncFrames = 8
+	// maxSyncBuffered stops the host queueing frames on a slow link.
+	maxSyncBuffered = 64 * 1024
+	// maxSyncFrame is the largest frame the host sends. It's well under the
+	// 64KiB messages every peer accepts, and losing a frame loses little.
+	maxSyncFrame = 16 * 1024
+)
+
+var errShortFrame = errors.New("screen frame is too short")
+
+// Glyph.Mode bits, as vt10x sets them.
+const (
+	glyphReverse = 1 << iota
+	glyphUnderline
+	glyphBold
+	glyphGfx
+	glyphItalic
+	glyphBlink
+
+	glyphAttrs = glyphReverse | glyphUnderline | glyphBold | glyphItalic | glyphBlink
+)
+
+// screenState is a copy of the emulated terminal.
+type screenState struct {
+	cols, rows    int
+	cells         []vt10x.Glyph
+	cursorX       int
+	cursorY       int
+	cursorVisible bool
+	appCursor     bool
+	appKeypad     bool
+	title         string
+}
+
+func snapshot(vt vt10x.Terminal) (s screenState) {
+	vt.Lock()
+	defer vt.Unlock()
+	s.cols, s.rows = vt.Size()
+	s.cells = make([]vt10x.Glyph, 0, s.cols*s.rows)
+	for y := 0; y < s.rows; y++ {
+		for x := 0; x < s.cols; x++ {
+			s.cells = append(s.cells, vt.Cell(x, y))
+		}
+	}
+	cur := vt.Cursor()
+	s.cursorX, s.cursorY = cur.X, cur.Y
+	s.cursorVisible = vt.CursorVisible()
+	s.appCursor = vt.Mode()&vt10x.ModeAppCursor != 0
+	s.appKeypad = vt.Mode()&vt10x.ModeAppKeypad != 0
+	s.title = vt.Title()
+	return
+}
+
+func (s screenState) equal(o screenState) bool {
+	if s.cols != o.cols || s.rows != o.rows || s.cursorX != o.cursorX ||
+		s.cursorY != o.cursorY || s.cursorVisible != o.cursorVisible ||
+		s.appCursor != o.appCursor || s.appKeypad != o.appKeypad || s.title != o.title {
+		return false
+	}
+	for i := range s.cells {
+		if !sameGlyph(s.cells[i], o.cells[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameGlyph(a, b vt10x.Glyph) bool {
+	if a.Char == 0 {
+		a.Char = ' '
+	}
+	if b.Char == 0 {
+		b.Char = ' '
+	}
+	return a.Char == b.Char && a.FG == b.FG && a.BG == b.BG &&
+		a.Mode&glyphAttrs == b.Mode&glyphAttrs
+}
+
+var blankGlyph = vt10x.Glyph{Char: ' ', FG: vt10x.DefaultFG, BG: vt10x.DefaultBG}
+
+// renderScreen returns the output that draws to on a terminal showing any
+// one of from. Cells are drawn if they differ from any screen in from, and
+// the whole screen is redrawn when from is empty or the size changed.
+func renderScreen(from []screenState, to screenState) []byte {
+	var b bytes.Buffer
+	full := len(from) == 0
+	for _, f := range from {
+		if f.cols != to.cols || f.rows != to.rows {
+			full = true
+		}
+	}
+	b.WriteString("\x1b[0m")
+	if full {
+		b.WriteString("\x1b[H\x1b[2J")
+	}
+
+	pen := blankGlyph
+	cx, cy := -1, -1
+	for i, g := range to.cells {
+		if full {
+			if sameGlyph(g, blankGlyph) {
+				continue
+			}
+		} else {
+			changed := false
+			for _, f := range from {
+				if !sameGlyph(f.cells[i], g) {
+					changed = true
+					break
+				}
+			}
+			if !changed {
+				continue
+			}
+		}
+		x, y := i%to.cols, i/to.cols
+		if x != cx || y != cy {
+			fmt.Fprintf(&b, "\x1b[%d;%dH", y+1, x+1)
+		}
+		if g.FG != pen.FG || g.BG != pen.BG || g.Mode&glyphAttrs != pen.Mode&glyphAttrs {
+			b.WriteString(sgr(g))
+			pen = g
+		}
+		if g.Char == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteRune(g.Char)
+		}
+		cx, cy = x+1, y
+		if cx >= to.cols {
+			// The cursor is waiting to wrap, so position it next time.
+			cx = -1
+		}
+	}
+	b.WriteString("\x1b[0m")
+
+	if to.appCursor {
+		b.WriteString("\x1b[?1h")
+	} else {
+		b.WriteString("\x1b[?1l")
+	}
+	if to.appKeypad {
+		b.WriteString("\x1b=")
+	} else {
+		b.WriteString("\x1b>")
+	}
+	for _, f := range from {
+		if f.title != to.title {
+			full = true
+		}
+	}
+	if full && to.title != "" {
+		fmt.Fprintf(&b, "\x1b]0;%s\a", to.title)
+	}
+	if to.cursorVisible {
+		b.WriteString("\x1b[?25h")
+	} else {
+		b.WriteString("\x1b[?25l")
+	}
+	fmt.Fprintf(&b, "\x1b[%d;%dH", to.cursorY+1, to.cursorX+1)
+	return b.Bytes()
+}
+
+// sgr returns the escape sequence that sets g's colors and attributes.
+func sgr(g vt10x.Glyph) string {
+	fg, bg := g.FG, g.BG
+	s := "\x1b[0"
+	if g.Mode&glyphBold != 0 {
+		s += ";1"
+	}
+	if g.Mode&glyphItalic != 0 {
+		s += ";3"
+	}
+	if g.Mode&glyphUnderline != 0 {
+		s += ";4"
+	}
+	if g.Mode&glyphBlink != 0 {
+		s += ";5"
+	}
+	if g.Mode&glyphReverse != 0 {
+		// vt10x stores reversed cells with their colors swapped.
+		s += ";7"
+		fg, bg = bg, fg
+	}
+	return s + sgrColor(fg, 30, vt10x.DefaultFG) + sgrColor(bg, 40, vt10x.DefaultBG) + "m"
+}
+
+func sgrColor(c vt10x.Color, base int, def vt10x.Color) string {
+	switch {
+	case c == def || c >= 1<<24:
+		return ""
+	case c < 8:
+		return fmt.Sprintf(";%d", base+int(c))
+	case c < 16:
+		return fmt.Sprintf(";%d", base+60+int(c)-8)
+	case c < 256:
+		return fmt.Sprintf(";%d;5;%d", base+8, c)
+	}
+	return fmt.Sprintf(";%d;2;%d;%d;%d", base+8, c>>16&0xff, c>>8&0xff, c&0xff)
+}
+
+// encodeFrame prefixes a screen update with its number and the number of
+// the oldest frame it can be drawn over, zero for a full redraw.
+func encodeFrame(num, base uint32, payload []byte) []byte {
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame, num)
+	binary.BigEndian.PutUint32(frame[4:], base)
+	return append(frame, payload...)
+}
+
+func decodeFrame(frame []byte) (num, base uint32, payload []byte, err error) {
+	if len(frame) < 8 {
+		return 0, 0, nil, errShortFrame
+	}
+	return binary.BigEndian.Uint32(frame), binary.BigEndian.Uint32(frame[4:]), frame[8:], nil
+}
+
+// acceptFrame reports whether a client showing frame state can draw frame
+// num, which was rendered for any frame from base onwards.
+func acceptFrame(state, num, base uint32) bool {
+	return num > state && base <= state
+}
+
+type sentScreen struct {
+	num    uint32
+	screen screenState
+}
+
+// screenSync runs the host side of -sync sessions, like mosh. Output from
+// the command goes to a terminal emulator, and the host sends frames that
+// bring the client's screen up to date over an unordered, unreliable
+// channel. Lost or late frames don't matter: each frame can be drawn over
+// the last screen the client acknowledged or any frame sent since.
+type screenSync struct {
+	mu       sync.Mutex
+	vt       vt10x.Terminal
+	partial  []byte
+	num      uint32
+	acked    uint32
+	sent     []sentScreen
+	lastSend time.Time
+}
+
+// newScreenSync creates the emulator. Its answers to terminal queries are
+// written to w, the pty.
+func newScreenSync(w io.Writer) *screenSync {
+	return &screenSync{vt: vt10x.New(vt10x.WithWriter(w))}
+}
+
+// Write feeds output from the command to the emulator.
+func (s *screenSync) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := append(s.partial, p...)
+	// Hold back a rune split across reads.
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if _, err := s.vt.Write(data[:end]); err != nil {
+		return 0, err
+	}
+	s.partial = append([]byte(nil), data[end:]...)
+	return len(p), nil
+}
+
+func (s *screenSync) resize(cols, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vt.Resize(cols, rows)
+}
+
+// ack records that the client is showing frame num.
+func (s *screenSync) ack(num uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.sent {
+		if s.sent[i].num == num {
+			s.acked = num
+			s.sent = s.sent[i:]
+			return
+		}
+	}
+}
+
+// frames returns the next frames to send, if the screen changed or the last
+// one hasn't been acknowledged in a while. There is more than one when the
+// screen is too big to redraw in a single frame.
+func (s *screenSync) frames(now time.Time) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	screen := snapshot(s.vt)
+	resend := false
+	if n := len(s.sent); n > 0 && s.sent[n-1].screen.equal(screen) {
+		if s.acked == s.sent[n-1].num || now.Sub(s.lastSend) < syncResend {
+			return nil
+		}
+		resend = true
+	}
+	full := len(s.sent) == 0 || len(s.sent) > maxSyncFrames || (resend && s.acked != s.sent[0].num)
+	for _, sent := range s.sent {
+		if sent.screen.cols != screen.cols || sent.screen.rows != screen.rows {
+			full = true
+		}
+	}
+	s.lastSend = now
+	if !full {
+		from := make([]screenState, len(s.sent))
+		for i := range s.sent {
+			from[i] = s.sent[i].screen
+		}
+		if payload := renderScreen(from, screen); len(payload) <= maxSyncFrame-8 {
+			s.num++
+			frame := encodeFrame(s.num, s.sent[0].num, payload)
+			s.sent = append(s.sent, sentScreen{num: s.num, screen: screen})
+			return [][]byte{frame}
+		}
+		// Too much changed, it's redrawn a few rows at a time instead.
+	}
+	return s.redraw(screen)
+}
+
+// redraw returns frames that draw screen from scratch. The first clears the
+// screen and draws as many rows as fit, and each of the rest draws more rows
+// over the frame before it. Only the last, complete, screen is drawn over
+// afterwards, so a client missing any part waits for the screen to be sent
+// again.
+func (s *screenSync) redraw(screen screenState) (frames [][]byte) {
+	s.sent = []sentScreen{{screen: screen}}
+	if payload := renderScreen(nil, screen); len(payload) <= maxSyncFrame-8 {
+		s.num++
+		s.sent[0].num = s.num
+		return [][]byte{encodeFrame(s.num, 0, payload)}
+	}
+	var base uint32
+	var prev []screenState
+	for rows := 0; rows < screen.rows; {
+		n := rows + 1
+		part := topRows(screen, n)
+		payload := renderScreen(prev, part)
+		for n < screen.rows {
+			next := topRows(screen, n+1)
+			p := renderScreen(prev, next)
+			if len(p) > maxSyncFrame-8 {
+				break
+			}
+			n, part, payload = n+1, next, p
+		}
+		s.num++
+		frames = append(frames, encodeFrame(s.num, base, payload))
+		base, prev, rows = s.num, []screenState{part}, n
+	}
+	s.sent[0].num = s.num
+	return frames
+}
+
+// topRows returns screen with every row from n down blank.
+func topRows(screen screenState, n int) screenState {
+	part := screen
+	part.cells = make([]vt10x.Glyph, len(screen.cells))
+	copy(part.cells, screen.cells[:n*screen.cols])
+	for i := n * screen.cols; i < len(part.cells); i++ {
+		part.cells[i] = blankGlyph
+	}
+	return part
+}
+
+// streamScreen sends frames on the sync channel until the connection
+// closes.
+func (hs *hostSession) streamScreen() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if hs.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		dc, _ := hs.syncDC.Load().(*webrtc.DataChannel)
+		if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen ||
+			dc.BufferedAmount() > maxSyncBuffered {
+			continue
+		}
+		for _, frame := range hs.screen.frames(now) {
+			if err := dc.Send(frame); err != nil {
+				log.Println(err)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hinshun/vt10x"
+)
+
+// syncClient draws frames like clientSession.syncOnMessage, on an emulator.
+type syncClient struct {
+	vt    vt10x.Terminal
+	state uint32
+}
+
+func (c *syncClient) receive(t *testing.T, frame []byte) (uint32, bool) {
+	num, base, payload, err := decodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acceptFrame(c.state, num, base) {
+		return 0, false
+	}
+	if _, err := c.vt.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	c.state = num
+	return num, true
+}
+
+func hostOutputStep(i int) string {
+	switch i % 5 {
+	case 0:
+		return fmt.Sprintf("\x1b[3%dmline %d\x1b[0m\r\n", i%8, i)
+	case 1:
+		return fmt.Sprintf("\x1b[%d;%dH\x1b[1;7m%c\x1b[0m", i%24+1, i%80+1, 'a'+i%26)
+	case 2:
+		return fmt.Sprintf("\x1b[5;1H\x1b[K\x1b[38;5;%dmcolor %d", i, i)
+	case 3:
+		return fmt.Sprintf("\x1b]0;title %d\a\x1b[?25l", i)
+	}
+	return "\x1b[?25h\x1b[4muncolored\x1b[24m \xe2\x94\x80"
+}
+
+func TestScreenSyncConverges(t *testing.T) {
+	host := newScreenSync(ioutil.Discard)
+	client := &syncClient{vt: vt10x.New()}
+	now := time.Now()
+	var delayed [][]byte
+
+	for i := 0; i < 300; i++ {
+		if _, err := host.Write([]byte(hostOutputStep(i))); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(syncInterval)
+		frames := host.frames(now)
+		if len(frames) == 0 {
+			continue
+		}
+		switch i % 7 {
+		case 1, 4:
+			// Lost.
+			continue
+		case 2:
+			// Arrives after the next frame.
+			delayed = append(delayed, frames...)
+			continue
+		}
+		for _, f := range append(frames, delayed...) {
+			if num, ok := client.receive(t, f); ok && i%5 != 3 {
+				// Some acks are lost too.
+				host.ack(num)
+			}
+		}
+		delayed = nil
+	}
+
+	// Once the link recovers the client catches up.
+	for i := 0; i < 10; i++ {
+		now = now.Add(syncResend)
+		for _, frame := range host.frames(now) {
+			if num, ok := client.receive(t, frame); ok {
+				host.ack(num)
+			}
+		}
+	}
+	if len(host.frames(now.Add(syncResend))) > 0 {
+		t.Error("an acknowledged screen shouldn't be sent again")
+	}
+	if want, got := snapshot(host.vt), snapshot(client.vt); !want.equal(got) {
+		t.Errorf("client screen doesn't match the host:\n%s\n---\n%s", host.vt, client.vt)
+	}
+}
+
+func TestScreenSyncResize(t *testing.T) {
+	host := newScreenSync(ioutil.Discard)
+	client := &syncClient{vt: vt10x.New()}
+	host.Write([]byte("hello"))
+	num, _ := client.receive(t, host.frames(time.Now())[0])
+	host.ack(num)
+
+	host.resize(40, 10)
+	client.vt.Resize(40, 10)
+	host.Write([]byte("\r\nworld"))
+	frames := host.frames(time.Now())
+	if len(frames) != 1 {
+		t.Fatalf("expected a frame after resizing, got %d", len(frames))
+	}
+	if _, base, _, _ := decodeFrame(frames[0]); base != 0 {
+		t.Error("a resized screen should be redrawn in full")
+	}
+	client.receive(t, frames[0])
+	if want, got := snapshot(host.vt), snapshot(client.vt); !want.equal(got) {
+		t.Errorf("client screen doesn't match the host:\n%s\n---\n%s", host.vt, client.vt)
+	}
+}
+
+// colorfulScreen fills every cell with its own colors and attributes.
+func colorfulScreen(cols, rows, seed int) string {
+	var b strings.Builder
+	for y := 0; y < rows; y++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", y+1)
+		for x := 0; x < cols; x++ {
+			n := x*rows + y + seed
+			fmt.Fprintf(&b, "\x1b[0;1;3;4;38;2;%d;%d;%d;48;2;%d;%d;%dm%c",
+				n%256, n/7%256, n/13%256, n/3%256, n%251, n/11%256, 'a'+n%26)
+		}
+	}
+	return b.String()
+}
+
+func TestScreenSyncLargeScreen(t *testing.T) {
+	const cols, rows = 200, 60
+	host := newScreenSync(ioutil.Discard)
+	host.resize(cols, rows)
+	client := &syncClient{vt: vt10x.New(vt10x.WithSize(cols, rows))}
+	now := time.Now()
+
+	check := func(frames [][]byte) {
+		t.Helper()
+		if len(frames) < 2 {
+			t.Fatalf("the screen should be split, got %d frames", len(frames))
+		}
+		for _, f := range frames {
+			if len(f) > maxSyncFrame {
+				t.Fatalf("%d byte frame is over %d", len(f), maxSyncFrame)
+			}
+		}
+		if _, base, _, _ := decodeFrame(frames[0]); base != 0 {
+			t.Error("the first part should clear the screen")
+		}
+	}
+
+	host.Write([]byte(colorfulScreen(cols, rows, 0)))
+	frames := host.frames(now)
+	check(frames)
+	var num uint32
+	for _, f := range frames {
+		var ok bool
+		if num, ok = client.receive(t, f); !ok {
+			t.Fatal("parts should be drawn in order")
+		}
+	}
+	host.ack(num)
+	if want, got := snapshot(host.vt), snapshot(client.vt); !want.equal(got) {
+		t.Fatal("client screen doesn't match the host")
+	}
+
+	// Changing every cell is too much for one frame, so the screen is
+	// redrawn. A client missing a part can't draw the rest.
+	host.Write([]byte(colorfulScreen(cols, rows, 1)))
+	now = now.Add(syncInterval)
+	frames = host.frames(now)
+	check(frames)
+	for _, f := range frames[1:] {
+		if _, ok := client.receive(t, f); ok {
+			t.Fatal("parts after a lost one shouldn't be drawn")
+		}
+	}
+	frames = host.frames(now.Add(syncResend))
+	check(frames)
+	for _, f := range frames {
+		num, _ = client.receive(t, f)
+	}
+	host.ack(num)
+	if want, got := snapshot(host.vt), snapshot(client.vt); !want.equal(got) {
+		t.Error("client screen doesn't match the host")
+	}
+	if len(host.frames(now.Add(2*syncResend))) > 0 {
+		t.Error("an acknowledged screen shouldn't be sent again")
+	}
+}
+
+func TestScreenSyncSplitRune(t *testing.T) {
+	host := newScreenSync(ioutil.Discard)
+	host.Write([]byte("\xe2\x94"))
+	host.Write([]byte("\x80"))
+	if c := host.vt.Cell(0, 0).Char; c != '─' {
+		t.Errorf("got %q", c)
+	}
+}
+
+func TestAcceptFrame(t *testing.T) {
+	for _, tt := range []struct {
+		state, num, base uint32
+		accept           bool
+	}{
+		{0, 1, 0, true},
+		{3, 5, 0, true},
+		{3, 5, 2, true},
+		{3, 5, 3, true},
+		{3, 5, 4, false},
+		{5, 5, 0, false},
+		{5, 4, 2, false},
+	} {
+		if got := acceptFrame(tt.state, tt.num, tt.base); got != tt.accept {
+			t.Errorf("acceptFrame(%d, %d, %d) = %t", tt.state, tt.num, tt.base, got)
+		}
+	}
+	if _, _, _, err := decodeFrame([]byte{1, 2}); err != errShortFrame {
+		t.Error(err)
+	}
+}
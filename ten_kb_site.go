@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -42,10 +43,20 @@ func read10kbFile(path string) (int, string, error) {
 	return resp.StatusCode, string(body), nil
 }
 
-func pollForResponse(path string) (body string, err error) {
+var errPollTimeout = errors.New("timed out waiting for a response")
+
+// pollForResponse polls path until a body is posted. A zero timeout polls
+// forever.
+func pollForResponse(path string, timeout time.Duration) (body string, err error) {
 	var sc int
-	// timeout?
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
 	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return "", errPollTimeout
+		}
 		sc, body, err = read10kbFile(path)
 		if err != nil {
 			return
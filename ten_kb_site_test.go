@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreate10kbFile(t *testing.T) {
@@ -112,7 +113,7 @@ func TestPollForResponse(t *testing.T) {
 	}))
 	tenKbURL = ts.URL + "/"
 
-	body, err := pollForResponse("path")
+	body, err := pollForResponse("path", 0)
 	if body != "body" {
 		t.Error(body)
 	}
@@ -121,3 +122,15 @@ func TestPollForResponse(t *testing.T) {
 	}
 
 }
+
+func TestPollForResponseTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	tenKbURL = ts.URL + "/"
+
+	_, err := pollForResponse("path", 500*time.Millisecond)
+	if err != errPollTimeout {
+		t.Error("should have timed out", err)
+	}
+}
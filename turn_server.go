@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/colorstring"
+	"github.com/pion/turn/v2"
+)
+
+var errNoTURNAuth = errors.New("set -users or -secret so clients can authenticate")
+
+// turnAuthHandler accepts static users and, when secret is set, time-limited
+// credentials made by turnRESTCredentials. REST usernames are an expiry
+// timestamp optionally followed by ":" and a user id.
+func turnAuthHandler(users map[string]string, secret string) turn.AuthHandler {
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if password, ok := users[username]; ok {
+			return turn.GenerateAuthKey(username, realm, password), true
+		}
+		if secret == "" {
+			log.Printf("TURN: unknown user %q from %s\n", username, srcAddr)
+			return nil, false
+		}
+		expiry, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+		if err != nil || expiry < time.Now().Unix() {
+			log.Printf("TURN: invalid or expired username %q from %s\n", username, srcAddr)
+			return nil, false
+		}
+		return turn.GenerateAuthKey(username, realm, turnRESTPassword(secret, username)), true
+	}
+}
+
+func parseTURNUsers(value string) (map[string]string, error) {
+	users := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("user %q should be written as username=password", pair)
+		}
+		users[pair[:i]] = pair[i+1:]
+	}
+	return users, nil
+}
+
+// outboundIP finds the address of the interface used to reach the internet.
+// Dialing UDP doesn't send any packets.
+func outboundIP() (net.IP, error) {
+	conn, err := net.Dial("udp4", "8.8.8.8:80")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// newTURNServer listens for STUN and TURN on UDP and TCP addr and hands out
+// relays on relayIP.
+func newTURNServer(addr string, relayIP net.IP, realm string, auth turn.AuthHandler) (*turn.Server, error) {
+	udpConn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	relay := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorStatic{RelayAddress: relayIP, Address: "0.0.0.0"}
+	}
+	return turn.NewServer(turn.ServerConfig{
+		Realm:             realm,
+		AuthHandler:       auth,
+		PacketConnConfigs: []turn.PacketConnConfig{{PacketConn: udpConn, RelayAddressGenerator: relay()}},
+		ListenerConfigs:   []turn.ListenerConfig{{Listener: tcpListener, RelayAddressGenerator: relay()}},
+	})
+}
+
+// turnServerCommand runs a STUN/TURN server until interrupted so teams can
+// host their own connectivity next to webtty.
+func turnServerCommand(flags *flag.FlagSet) func() error {
+	port := flags.Int("port", 3478, "UDP and TCP port to listen on")
+	publicIP := flags.String("public-ip", "", "The address clients reach this server on. Defaults to the outbound interface address")
+	realm := flags.String("realm", "webtty", "The authentication realm")
+	usersFlag := flags.String("users", "", "Static users, eg: alice=password1,bob=password2")
+	secret := flags.String("secret", "", "Shared secret for time-limited credentials, give clients the same value with -ice-secret")
+	return func() error {
+		return runTURNServer(*port, *publicIP, *realm, *usersFlag, *secret)
+	}
+}
+
+func runTURNServer(port int, publicIP, realm, usersFlag, secret string) error {
+	users, err := parseTURNUsers(usersFlag)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 && secret == "" {
+		return errNoTURNAuth
+	}
+	var relayIP net.IP
+	if publicIP != "" {
+		if relayIP = net.ParseIP(publicIP); relayIP == nil {
+			return fmt.Errorf("invalid -public-ip %q", publicIP)
+		}
+	} else if relayIP, err = outboundIP(); err != nil {
+		return err
+	}
+
+	server, err := newTURNServer(fmt.Sprintf("0.0.0.0:%d", port), relayIP, realm,
+		turnAuthHandler(users, secret))
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	hostport := net.JoinHostPort(relayIP.String(), strconv.Itoa(port))
+	colorstring.Printf("[bold]STUN/TURN server listening on [reset]%s\n\n", hostport)
+	colorstring.Printf("[bold]Point webtty at it with:\n")
+	for user := range users {
+		fmt.Printf("  -ice turn:%s:PASSWORD@%s\n", user, hostport)
+	}
+	if secret != "" {
+		fmt.Printf("  -ice turn:%s -ice-secret SECRET\n", hostport)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestTURNAuthHandler(t *testing.T) {
+	users, err := parseTURNUsers("alice=one, bob=two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := turnAuthHandler(users, "secret")
+	addr := &net.UDPAddr{}
+
+	key, ok := auth("alice", "webtty", addr)
+	if !ok || string(key) != string(turn.GenerateAuthKey("alice", "webtty", "one")) {
+		t.Error("static user should authenticate")
+	}
+	if _, ok = auth("mallory", "webtty", addr); ok {
+		t.Error("unknown users shouldn't authenticate")
+	}
+
+	username, password := turnRESTCredentials("secret", "webtty", time.Hour)
+	key, ok = auth(username, "webtty", addr)
+	if !ok || string(key) != string(turn.GenerateAuthKey(username, "webtty", password)) {
+		t.Error("REST credentials should authenticate")
+	}
+	username, _ = turnRESTCredentials("secret", "webtty", -time.Hour)
+	if _, ok = auth(username, "webtty", addr); ok {
+		t.Error("expired REST credentials shouldn't authenticate")
+	}
+
+	if _, err = parseTURNUsers("alice"); err == nil {
+		t.Error("users need a password")
+	}
+}
+
+func TestRelayOnlyThroughTURNServer(t *testing.T) {
+	ln, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.LocalAddr().(*net.UDPAddr).Port
+	ln.Close()
+
+	server, err := newTURNServer(fmt.Sprintf("127.0.0.1:%d", port), net.ParseIP("127.0.0.1"),
+		"webtty", turnAuthHandler(nil, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	servers := []webrtc.ICEServer{{URLs: []string{fmt.Sprintf("turn:127.0.0.1:%d", port)}}}
+	applyTURNSecret(servers, "secret", time.Hour)
+	host := session{iceServers: servers, relayOnly: true}
+	client := session{iceServers: servers, relayOnly: true}
+	connectPeers(t, &host, &client)
+	defer host.pc.Close()
+	defer client.pc.Close()
+
+	// AllocationCount isn't safe to call while the server is running.
+	if stats := host.connStats(nil); stats.local != "relay" || stats.remote != "relay" {
+		t.Errorf("connection should go through the relay, got %s-%s", stats.local, stats.remote)
+	}
+}
@@ -92,7 +92,8 @@ let log = msg => {
   term.write(msg + "\n\r");
 };
 
-let sendChannel = pc.createDataChannel("data");
+// The browser answers the host's pings, see terminadoAttach.
+let sendChannel = pc.createDataChannel("data", { protocol: "heartbeat" });
 sendChannel.onclose = () => console.log("sendChannel has closed");
 sendChannel.onopen = () => {
   term.reset();
@@ -63,12 +63,41 @@ export function terminadoAttach(
         fileReader.readAsArrayBuffer(ev.data);
       }
     } else if (typeof ev.data === "string") {
+      if (handleControlMessage(ev.data)) {
+        return;
+      }
       displayData(ev.data);
     } else {
       throw Error(`Cannot handle "${typeof ev.data}" websocket message.`);
     }
   };
 
+  /**
+   * Handle control messages from the host, JSON arrays of strings like
+   * ["ping", "<timestamp>"]. Returns false for anything else.
+   *
+   * @param data The string message.
+   */
+  function handleControlMessage(data: string): boolean {
+    if (data.substr(0, 2) !== '["') {
+      return false;
+    }
+    let msg: string[];
+    try {
+      msg = JSON.parse(data);
+    } catch (e) {
+      return false;
+    }
+    switch (msg[0]) {
+      case "ping":
+        socket.send(JSON.stringify(["pong", msg[1]]));
+        return true;
+      case "pong":
+        return true;
+    }
+    return false;
+  }
+
   /**
    * Push data to buffer or write it in the terminal.
    * This is used as a callback for FileReader.onload.
@@ -46,6 +46,9 @@ func decode(this js.Value, i []js.Value) interface{} {
 		if err != nil {
 			return "", "", err.Error()
 		}
+		if offer.Expired() {
+			return "", "", sd.ErrExpired.Error()
+		}
 		if offer.Key != "" {
 			key = offer.Key
 			nonce = offer.Nonce